@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"archive/tar"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// PackDir writes the regular files under dir to w as a tar archive. Files
+// that would take the archive past limit bytes of content are left out and
+// their paths returned; a limit of 0 means no limit. A missing dir gives an
+// empty archive.
+func PackDir(w io.Writer, dir string, limit int64) ([]string, error) {
+	tw := tar.NewWriter(w)
+	var (
+		total   int64
+		skipped []string
+	)
+
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		// Symlinks, devices and the like are never collected
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if limit > 0 && total+info.Size() > limit {
+			skipped = append(skipped, rel)
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(rel),
+			Mode:     int64(info.Mode().Perm()),
+			Size:     info.Size(),
+			ModTime:  info.ModTime(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		// CopyN keeps the entry the size its header claims even if the
+		// file is still changing
+		if _, err := io.CopyN(tw, f, info.Size()); err != nil {
+			return err
+		}
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return skipped, err
+	}
+	return skipped, tw.Close()
+}
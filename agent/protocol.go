@@ -0,0 +1,229 @@
+// Package agent defines the wire protocol between the host and the guest
+// agent baked into the rootfs. The host connects to the agent over
+// Firecracker's vsock device and the two exchange frames: a one-byte frame
+// type, a four-byte big-endian payload length, then the payload.
+//
+// A session is: host sends FrameSpec, followed by a tar archive of the
+// job's files as FrameFiles chunks and an empty FrameFiles if the spec has
+// InlineFiles set; guest streams FrameStdout and FrameStderr while the job
+// runs, then a tar archive of the job's output directory as FrameArtifact
+// chunks, then sends FrameExit (or FrameError if the job could not be
+// started); host sends FrameShutdown; guest answers with FrameAck and
+// reboots, which makes Firecracker exit.
+//
+// Before that the host may check on a parked guest or prepare it: a
+// connection opening with FramePing, FrameWarmup or FrameIdentity is
+// answered with FrameAck (or FrameError if the request failed) and closed,
+// and the agent goes on waiting for its job.
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Port is the vsock port the guest agent listens on
+const Port uint32 = 1024
+
+// MaxFrameSize bounds a single frame's payload
+const MaxFrameSize = 16 << 20
+
+// FrameType identifies the payload of a frame
+type FrameType byte
+
+const (
+	// FrameSpec carries the JSON Spec of the job to run (host to guest)
+	FrameSpec FrameType = 's'
+	// FrameFiles carries a chunk of the archive of the job's files; an
+	// empty one ends the archive (host to guest)
+	FrameFiles FrameType = 'd'
+	// FramePing asks an idle guest whether it can take a job (host to guest)
+	FramePing FrameType = 'p'
+	// FrameWarmup carries a JSON command for an idle guest to run before
+	// it is snapshotted, such as one loading the runtime (host to guest)
+	FrameWarmup FrameType = 'w'
+	// FrameIdentity carries the JSON Identity of a guest restored from a
+	// snapshot (host to guest)
+	FrameIdentity FrameType = 'i'
+	// FrameStdout carries a chunk of the job's stdout (guest to host)
+	FrameStdout FrameType = 'o'
+	// FrameStderr carries a chunk of the job's stderr (guest to host)
+	FrameStderr FrameType = 'e'
+	// FrameArtifact carries a chunk of the output archive (guest to host)
+	FrameArtifact FrameType = 'f'
+	// FrameExit carries the JSON Exit of the finished job (guest to host)
+	FrameExit FrameType = 'x'
+	// FrameError carries a message when the job could not run (guest to host)
+	FrameError FrameType = '!'
+	// FrameShutdown asks the guest to power off (host to guest)
+	FrameShutdown FrameType = 'q'
+	// FrameAck acknowledges FrameShutdown, FramePing, FrameWarmup or
+	// FrameIdentity (guest to host)
+	FrameAck FrameType = 'a'
+)
+
+// Spec describes the job the agent should run
+type Spec struct {
+	// Command is the interpreter and script to execute
+	Command []string `json:"command"`
+	// Args are appended to Command
+	Args []string `json:"args,omitempty"`
+	// Env is added to the agent's own environment
+	Env map[string]string `json:"env,omitempty"`
+	// Dir is the working directory; the job's files are unpacked here
+	Dir string `json:"dir"`
+	// Drive is a block device holding a tar archive of the job's files
+	Drive string `json:"drive,omitempty"`
+	// InlineFiles says the archive follows the spec as FrameFiles instead,
+	// for guests booted before their job was known
+	InlineFiles bool `json:"inline_files,omitempty"`
+	// Stdin is fed to the job's standard input
+	Stdin []byte `json:"stdin,omitempty"`
+	// OutDir is archived and sent back once the job exits
+	OutDir string `json:"out_dir,omitempty"`
+	// MaxOutBytes bounds the file content sent back from OutDir
+	MaxOutBytes int64 `json:"max_out_bytes,omitempty"`
+}
+
+// Exit reports how the job ended and what it consumed
+type Exit struct {
+	Code      int           `json:"code"`
+	UserCPU   time.Duration `json:"user_cpu"`
+	SystemCPU time.Duration `json:"system_cpu"`
+	MaxRSSKB  int64         `json:"max_rss_kb"`
+	// Skipped lists output files left out of the archive for size
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Identity is what a guest restored from a snapshot takes over from the
+// guest the snapshot was made of, which every guest restored from it
+// would otherwise share
+type Identity struct {
+	// MAC and Address, in CIDR form, are given to eth0 with a default
+	// route through Gateway; all three are empty for a guest without
+	// networking
+	MAC     string `json:"mac,omitempty"`
+	Address string `json:"address,omitempty"`
+	Gateway string `json:"gateway,omitempty"`
+	// Seed is mixed into the kernel's entropy pool before it is reseeded
+	Seed []byte `json:"seed"`
+	// Time is the host's clock, which the guest's is set to
+	Time time.Time `json:"time"`
+}
+
+// Conn sends and receives frames over a connection. Send is safe for
+// concurrent use; Recv is not.
+type Conn struct {
+	rw io.ReadWriter
+	mu sync.Mutex
+}
+
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{rw: rw}
+}
+
+// Send writes a single frame
+func (c *Conn) Send(t FrameType, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds limit", len(payload))
+	}
+
+	hdr := make([]byte, 5)
+	hdr[0] = byte(t)
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.rw.Write(hdr); err != nil {
+		return err
+	}
+	_, err := c.rw.Write(payload)
+	return err
+}
+
+// SendJSON writes a frame with v encoded as its payload
+func (c *Conn) SendJSON(t FrameType, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Send(t, payload)
+}
+
+// Recv reads the next frame
+func (c *Conn) Recv() (FrameType, []byte, error) {
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(c.rw, hdr); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > MaxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds limit", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	return FrameType(hdr[0]), payload, nil
+}
+
+// Writer returns an io.Writer that sends everything written to it as
+// frames of type t
+func (c *Conn) Writer(t FrameType) io.Writer {
+	return frameWriter{c: c, t: t}
+}
+
+type frameWriter struct {
+	c *Conn
+	t FrameType
+}
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	for off := 0; off < len(p); off += MaxFrameSize {
+		end := off + MaxFrameSize
+		if end > len(p) {
+			end = len(p)
+		}
+		if err := w.c.Send(w.t, p[off:end]); err != nil {
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+// Reader returns an io.Reader over the payloads of the frames of type t
+// that come next, ending at an empty one. Any other frame is an error.
+func (c *Conn) Reader(t FrameType) io.Reader {
+	return &frameReader{c: c, t: t}
+}
+
+type frameReader struct {
+	c    *Conn
+	t    FrameType
+	buf  []byte
+	done bool
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		t, payload, err := r.c.Recv()
+		if err != nil {
+			return 0, err
+		}
+		if t != r.t {
+			return 0, fmt.Errorf("expected frame %q, got %q", r.t, t)
+		}
+		r.buf, r.done = payload, len(payload) == 0
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
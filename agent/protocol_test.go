@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestConnRoundTrip(t *testing.T) {
+	frames := []struct {
+		t       FrameType
+		payload []byte
+	}{
+		{FrameSpec, []byte(`{"command":["sh"]}`)},
+		{FrameStdout, []byte("hello\n")},
+		{FrameShutdown, nil},
+		{FrameExit, bytes.Repeat([]byte("x"), 70000)},
+	}
+
+	var buf bytes.Buffer
+	c := NewConn(&buf)
+	for _, f := range frames {
+		if err := c.Send(f.t, f.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range frames {
+		typ, payload, err := c.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ != f.t || !bytes.Equal(payload, f.payload) {
+			t.Errorf("got frame %q of %d bytes, want %q of %d", typ, len(payload), f.t, len(f.payload))
+		}
+	}
+	if _, _, err := c.Recv(); err != io.EOF {
+		t.Errorf("got %v after the last frame, want EOF", err)
+	}
+}
+
+func TestConnRecvErrors(t *testing.T) {
+	oversized := make([]byte, 5)
+	oversized[0] = byte(FrameStdout)
+	binary.BigEndian.PutUint32(oversized[1:], MaxFrameSize+1)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"short header", []byte{byte(FrameStdout), 0, 0}},
+		{"short payload", []byte{byte(FrameStdout), 0, 0, 0, 4, 'a', 'b'}},
+		{"oversized", oversized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := NewConn(bytes.NewBuffer(tt.data)).Recv(); err == nil {
+				t.Error("bad frame accepted")
+			}
+		})
+	}
+}
+
+func TestConnSendOversized(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewConn(&buf).Send(FrameStdout, make([]byte, MaxFrameSize+1)); err == nil {
+		t.Error("oversized frame sent")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes written for a rejected frame", buf.Len())
+	}
+}
+
+func TestConnWriterReader(t *testing.T) {
+	var buf bytes.Buffer
+	c := NewConn(&buf)
+	w := c.Writer(FrameFiles)
+	io.WriteString(w, "first ")
+	io.WriteString(w, "second")
+	c.Send(FrameFiles, nil)
+
+	got, err := io.ReadAll(c.Reader(FrameFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "first second" {
+		t.Errorf("got %q", got)
+	}
+
+	// Any other frame in the stream is an error
+	buf.Reset()
+	c.Send(FrameFiles, []byte("data"))
+	c.Send(FrameStdout, []byte("stray"))
+	_, err = io.ReadAll(c.Reader(FrameFiles))
+	if err == nil || !strings.Contains(err.Error(), "expected frame") {
+		t.Errorf("got %v, want an unexpected frame error", err)
+	}
+}
@@ -1,91 +1,185 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/google/uuid"
 	"github.com/steveoni/microvm/db"
 	"github.com/steveoni/microvm/jobs"
+	"github.com/steveoni/microvm/runtimes"
+	"github.com/steveoni/microvm/storage"
 )
 
 type UploadResponse struct {
-	ScriptID string `json:"script_id"`
+	ScriptID   string `json:"script_id"`
+	Entrypoint string `json:"entrypoint"`
+	Runtime    string `json:"runtime"`
+	Revision   int    `json:"revision"`
 }
 
+// UploadScript stores a new script. The multipart form carries one or more
+// `script` files and/or a `bundle` archive (.tar, .tar.gz, .tgz or .zip),
+// plus an `entrypoint` naming the file to run when there is more than one
+// and a `runtime` when it can't be told from the entrypoint.
 func UploadScript(w http.ResponseWriter, r *http.Request) {
-	file, header, err := r.FormFile("script")
+	upload, meta, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	defer upload.Discard()
+	defer r.MultipartForm.RemoveAll()
+
+	meta.Owner = r.FormValue("owner")
+	script, err := upload.Commit(meta)
 	if err != nil {
-		http.Error(w, "invalid file upload", http.StatusBadRequest)
+		uploadError(w, err)
 		return
 	}
-	defer file.Close()
 
-	// Get the original file extension
-    originalFilename := header.Filename
-    extension := filepath.Ext(originalFilename)
-    if extension == "" {
-        extension = ".sh" // Default to shell script if no extension provided
-    }
+	resp := UploadResponse{ScriptID: script.ID, Entrypoint: script.Entrypoint, Runtime: script.Runtime, Revision: script.Revision}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
 
-	scriptID := uuid.NewString()
-	scriptPath := filepath.Join("scripts", scriptID+extension)
+// readUpload stages the files of an upload form and returns what the form
+// says about them. It has already replied when it returns false.
+func readUpload(w http.ResponseWriter, r *http.Request) (*storage.Upload, db.Script, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBodySize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "invalid file upload", http.StatusBadRequest)
+		return nil, db.Script{}, false
+	}
 
-	if err := os.MkdirAll("scripts", 0755); err != nil {
-		http.Error(w, "failed to prepare storage", http.StatusInternalServerError)
-		return
+	scripts := r.MultipartForm.File["script"]
+	bundles := r.MultipartForm.File["bundle"]
+	if len(scripts)+len(bundles) == 0 {
+		r.MultipartForm.RemoveAll()
+		http.Error(w, "invalid file upload", http.StatusBadRequest)
+		return nil, db.Script{}, false
 	}
 
-	out, err := os.Create(scriptPath)
+	upload, err := storage.NewUpload()
 	if err != nil {
-		http.Error(w, "failed to save script", http.StatusInternalServerError)
-		return
+		r.MultipartForm.RemoveAll()
+		http.Error(w, "failed to prepare storage", http.StatusInternalServerError)
+		return nil, db.Script{}, false
 	}
-	defer func() {
-		if closeErr := out.Close(); closeErr != nil {
-			// Log the error or handle it appropriately
-			// For now, we'll ignore it as the main operation succeeded
+
+	add := func(header *multipart.FileHeader, bundle bool) error {
+		file, err := header.Open()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if bundle {
+			return upload.AddArchive(header.Filename, file)
 		}
-	}()
+		return upload.AddFile(header.Filename, file, 0755)
+	}
+	for i, header := range append(scripts, bundles...) {
+		if err := add(header, i >= len(scripts)); err != nil {
+			upload.Discard()
+			r.MultipartForm.RemoveAll()
+			uploadError(w, err)
+			return nil, db.Script{}, false
+		}
+	}
 
-	if _, err := io.Copy(out, file); err != nil {
-		http.Error(w, "failed to write script", http.StatusInternalServerError)
-		// Clean up the partially written file
-		os.Remove(scriptPath)
-		return
+	// A bundle is known by its archive's name, loose files by the one run
+	filename := ""
+	if len(bundles) > 0 {
+		filename = bundles[0].Filename
+	} else if len(scripts) == 1 {
+		filename = scripts[0].Filename
+	}
+	meta := db.Script{
+		Filename:   filename,
+		Entrypoint: r.FormValue("entrypoint"),
+		Runtime:    r.FormValue("runtime"),
 	}
+	return upload, meta, true
+}
 
-	resp := UploadResponse{ScriptID: scriptID}
+// ListRuntimesHandler lists the runtimes scripts can be written for
+func ListRuntimesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+	if err := json.NewEncoder(w).Encode(runtimes.All()); err != nil {
+		http.Error(w, "failed to encode runtimes", http.StatusInternalServerError)
+		return
+	}
+}
+
+// maxUploadBodySize leaves room for the multipart framing around a script
+// tree of the largest allowed size
+const maxUploadBodySize = storage.MaxSize + 1<<20
+
+func uploadError(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrInvalidUpload) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	http.Error(w, "failed to save script", http.StatusInternalServerError)
 }
 
+// maxRunBodySize leaves room for the largest stdin a run may carry
+const maxRunBodySize = 4 << 20
+
+// RunScript queues a job running the script's latest revision, or the one
+// pinned with ?revision=
 func RunScript(w http.ResponseWriter, r *http.Request) {
 	scriptID := chi.URLParam(r, "id")
-    var fileExists bool
-    
-    // Check for common extensions
-    for _, ext := range []string{".py", ".sh", ""} {
-        path := filepath.Join("scripts", scriptID+ext)
-        if _, err := os.Stat(path); err == nil {
-            fileExists = true
-            break
-        }
-    }
-    
-    if !fileExists {
-        http.Error(w, "script not found", http.StatusNotFound)
-        return
-    }
-
-	info, err := jobs.EnqueueScript(scriptID)
+	script, err := db.GetScriptByID(scriptID)
+	if err != nil {
+		http.Error(w, "script not found", http.StatusNotFound)
+		return
+	}
+	if script.DeletedAt != "" {
+		http.Error(w, "script has been deleted", http.StatusGone)
+		return
+	}
+	revision, ok := lookupRevision(w, r, script)
+	if !ok {
+		return
+	}
+
+	// The body is optional; without one the run gets the server defaults
+	var opts jobs.RunOptions
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRunBodySize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&opts); err != nil && err != io.EOF {
+		http.Error(w, "invalid run options: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := opts.Resources()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inv, err := opts.Invocation()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	labels, err := opts.JobLabels()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	jobID, err := jobs.EnqueueScript(scriptID, revision.Revision, res, inv, labels)
 	if err != nil {
 		http.Error(w, "failed to enqueue job", http.StatusInternalServerError)
 		return
@@ -93,7 +187,8 @@ func RunScript(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"job_id": info.ID,
+		"job_id":   jobID,
+		"revision": revision.Revision,
 	}); err != nil {
 		http.Error(w, "failed to encode response", http.StatusInternalServerError)
 		return
@@ -116,10 +211,121 @@ func GetJobStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// CancelJobHandler stops a queued or running job. A running job is stopped
+// asynchronously, so the job may still be cancelling when this returns.
+func CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "id")
+
+	err := jobs.Cancel(jobID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	case errors.Is(err, jobs.ErrJobFinished):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "failed to cancel job", http.StatusInternalServerError)
+		return
+	}
+
+	job, err := db.GetJobByID(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		http.Error(w, "failed to encode job data", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListArtifactsHandler lists the files a job handed back through $OUT_DIR
+func ListArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "id")
+
+	if _, err := db.GetJobByID(jobID); err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	artifacts, err := jobs.ListArtifacts(jobID)
+	if err != nil {
+		http.Error(w, "failed to list artifacts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(artifacts); err != nil {
+		http.Error(w, "failed to encode artifacts", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetArtifactHandler downloads one of a job's artifacts
+func GetArtifactHandler(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "id")
+
+	if _, err := db.GetJobByID(jobID); err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	file, err := jobs.ArtifactFile(jobID, chi.URLParam(r, "*"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to read artifact", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(file)}))
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
+
+// followInterval is how often a followed log is checked for new output
+const followInterval = 500 * time.Millisecond
+
+// GetJobLogHandler returns one of a job's log streams, selected with
+// ?stream=. The default is the script's own output. With ?follow=true the
+// response is streamed as the job writes it and ends once the job finishes.
 func GetJobLogHandler(w http.ResponseWriter, r *http.Request) {
 	jobID := chi.URLParam(r, "id")
 
-	logPath := filepath.Join("logs", jobID+".log")
+	job, err := db.GetJobByID(jobID)
+	if err != nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+	if stream == "" {
+		stream = jobs.StreamOutput
+	}
+	logPath, err := jobs.LogFile(job.LogPath, stream)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if follow, _ := strconv.ParseBool(r.URL.Query().Get("follow")); follow {
+		followLog(w, r, job.ID, logPath)
+		return
+	}
+
 	content, err := os.ReadFile(logPath)
 	if err != nil {
 		http.Error(w, "log not found", http.StatusNotFound)
@@ -132,3 +338,71 @@ func GetJobLogHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// followLog streams logPath to the client until the job is finished or the
+// client goes away. The log may not exist yet while the job is queued.
+func followLog(w http.ResponseWriter, r *http.Request, jobID, logPath string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	// Stops browsers buffering the response to sniff its type
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	var offset int64
+	for {
+		// Check the status before reading so the last read, once the job
+		// has finished, picks up everything it wrote
+		job, err := db.GetJobByID(jobID)
+		if err != nil {
+			return
+		}
+		done := jobs.Finished(job.Status)
+
+		offset, err = copyLogFrom(w, logPath, offset)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// copyLogFrom writes everything in path past offset to w and returns the
+// new offset
+func copyLogFrom(w io.Writer, path string, offset int64) (int64, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return offset, nil
+	}
+	if err != nil {
+		return offset, err
+	}
+	defer f.Close()
+
+	// A retried job starts its logs afresh
+	if fi, err := f.Stat(); err == nil && fi.Size() < offset {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, err
+	}
+	n, err := io.Copy(w, f)
+	return offset + n, err
+}
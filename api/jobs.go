@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/steveoni/microvm/db"
+)
+
+// Page sizes for GET /jobs
+const (
+	defaultJobsLimit = 50
+	maxJobsLimit     = 500
+)
+
+// JobList is a page of GET /jobs. NextCursor is empty on the last page.
+type JobList struct {
+	Jobs       []db.Job `json:"jobs"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// jobCursor is what a next_cursor carries. It names the order it was made
+// for so it can't be used to continue a different one.
+type jobCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    string `json:"i"`
+}
+
+// ListJobsHandler lists jobs, newest first unless asked otherwise. Jobs are
+// filtered with ?script_id=, ?status= (repeated or comma separated),
+// ?started_after=, ?started_before=, ?finished_after=, ?finished_before=
+// and ?label=key=value (repeated), sorted with ?sort=started_at|finished_at
+// and ?order=asc|desc, and paged with ?limit= and ?cursor=.
+func ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseJobFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// One more than asked for tells whether there's another page
+	limit := filter.Limit
+	filter.Limit++
+	list, err := db.ListJobs(filter)
+	if err != nil {
+		http.Error(w, "failed to list jobs", http.StatusInternalServerError)
+		return
+	}
+
+	resp := JobList{Jobs: list}
+	if len(list) > limit {
+		resp.Jobs = list[:limit]
+		last := resp.Jobs[limit-1].Cursor(filter.SortBy)
+		resp.NextCursor = encodeJobCursor(jobCursor{
+			Sort:  filter.SortBy,
+			Desc:  filter.Desc,
+			Value: last.Value,
+			ID:    last.ID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode jobs", http.StatusInternalServerError)
+		return
+	}
+}
+
+func parseJobFilter(r *http.Request) (db.JobFilter, error) {
+	q := r.URL.Query()
+	f := db.JobFilter{
+		ScriptID: q.Get("script_id"),
+		SortBy:   db.SortStartedAt,
+		Desc:     true,
+		Limit:    defaultJobsLimit,
+	}
+
+	for _, v := range q["status"] {
+		for _, status := range strings.Split(v, ",") {
+			if status = strings.TrimSpace(status); status != "" {
+				f.Statuses = append(f.Statuses, status)
+			}
+		}
+	}
+
+	for _, b := range []struct {
+		name string
+		dst  *string
+	}{
+		{"started_after", &f.StartedAfter},
+		{"started_before", &f.StartedBefore},
+		{"finished_after", &f.FinishedAfter},
+		{"finished_before", &f.FinishedBefore},
+	} {
+		v := q.Get(b.name)
+		if v == "" {
+			continue
+		}
+		t, err := parseJobTime(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s: %v", b.name, err)
+		}
+		*b.dst = t
+	}
+
+	for _, v := range q["label"] {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return f, fmt.Errorf("invalid label %q, want key=value", v)
+		}
+		if f.Labels == nil {
+			f.Labels = make(map[string]string)
+		}
+		f.Labels[key] = value
+	}
+
+	switch v := q.Get("sort"); v {
+	case "", db.SortStartedAt:
+	case db.SortFinishedAt:
+		f.SortBy = v
+	default:
+		return f, fmt.Errorf("invalid sort %q, want %s or %s", v, db.SortStartedAt, db.SortFinishedAt)
+	}
+	switch v := q.Get("order"); v {
+	case "", "desc":
+	case "asc":
+		f.Desc = false
+	default:
+		return f, fmt.Errorf("invalid order %q, want asc or desc", v)
+	}
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxJobsLimit {
+			return f, fmt.Errorf("limit must be between 1 and %d", maxJobsLimit)
+		}
+		f.Limit = n
+	}
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeJobCursor(v)
+		if err != nil || c.Sort != f.SortBy || c.Desc != f.Desc {
+			return f, fmt.Errorf("invalid cursor")
+		}
+		f.After = &db.JobCursor{Value: c.Value, ID: c.ID}
+	}
+	return f, nil
+}
+
+// parseJobTime takes an RFC 3339 time, or a duration meaning that long
+// ago, and returns it the way job times are stored
+func parseJobTime(v string) (string, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		d, derr := time.ParseDuration(v)
+		if derr != nil || d < 0 {
+			return "", fmt.Errorf("want an RFC 3339 time or a duration ago, got %q", v)
+		}
+		t = time.Now().Add(-d)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+func encodeJobCursor(c jobCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeJobCursor(s string) (jobCursor, error) {
+	var c jobCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(data, &c)
+	return c, err
+}
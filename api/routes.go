@@ -1,6 +1,7 @@
 package api
 
 import (
+	"expvar"
 	"github.com/go-chi/chi/v5"
 	"net/http"
 )
@@ -9,9 +10,22 @@ func NewRouter() http.Handler {
 	r := chi.NewRouter()
 
 	r.Post("/scripts", UploadScript)
+	r.Get("/scripts", ListScriptsHandler)
+	r.Get("/scripts/{id}", GetScriptHandler)
+	r.Get("/scripts/{id}/content", GetScriptContentHandler)
+	r.Put("/scripts/{id}", UpdateScriptHandler)
+	r.Delete("/scripts/{id}", DeleteScriptHandler)
+	r.Get("/scripts/{id}/revisions", ListRevisionsHandler)
+	r.Get("/scripts/{id}/revisions/{revision}", GetRevisionHandler)
 	r.Post("/scripts/{id}/run", RunScript)
+	r.Get("/runtimes", ListRuntimesHandler)
+	r.Get("/jobs", ListJobsHandler)
 	r.Get("/jobs/{id}", GetJobStatusHandler)
 	r.Get("/jobs/{id}/logs", GetJobLogHandler)
+	r.Post("/jobs/{id}/cancel", CancelJobHandler)
+	r.Get("/jobs/{id}/artifacts", ListArtifactsHandler)
+	r.Get("/jobs/{id}/artifacts/*", GetArtifactHandler)
+	r.Handle("/debug/vars", expvar.Handler())
 
 	return r
 }
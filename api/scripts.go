@@ -0,0 +1,288 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/steveoni/microvm/db"
+	"github.com/steveoni/microvm/storage"
+)
+
+// Page sizes for GET /scripts
+const (
+	defaultScriptsLimit = 50
+	maxScriptsLimit     = 500
+)
+
+// ScriptDetail is a script's record together with the files of its latest
+// revision
+type ScriptDetail struct {
+	db.Script
+	Files []string
+}
+
+// RevisionDetail is a script revision together with its files
+type RevisionDetail struct {
+	db.ScriptRevision
+	Files []string
+}
+
+// lookupRevision finds the revision of script named by ?revision=, or its
+// latest, writing the error response when there is none
+func lookupRevision(w http.ResponseWriter, r *http.Request, script *db.Script) (*db.ScriptRevision, bool) {
+	return findRevision(w, script, r.URL.Query().Get("revision"))
+}
+
+func findRevision(w http.ResponseWriter, script *db.Script, param string) (*db.ScriptRevision, bool) {
+	revision := script.Revision
+	if param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid revision", http.StatusBadRequest)
+			return nil, false
+		}
+		revision = n
+	}
+	rev, err := db.GetScriptRevision(script.ID, revision)
+	if err == sql.ErrNoRows {
+		http.Error(w, "revision not found", http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "failed to look up revision", http.StatusInternalServerError)
+		return nil, false
+	}
+	return rev, true
+}
+
+// ListScriptsHandler lists scripts, newest first. It takes ?runtime= and
+// ?owner= filters, ?include_deleted=true, and ?limit= and ?offset= to page.
+func ListScriptsHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := db.ScriptFilter{
+		Runtime: q.Get("runtime"),
+		Owner:   q.Get("owner"),
+		Limit:   defaultScriptsLimit,
+	}
+	var err error
+	if v := q.Get("include_deleted"); v != "" {
+		if filter.IncludeDeleted, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid include_deleted", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > maxScriptsLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxScriptsLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			http.Error(w, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+
+	scripts, err := db.ListScripts(filter)
+	if err != nil {
+		http.Error(w, "failed to list scripts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(scripts); err != nil {
+		http.Error(w, "failed to encode scripts", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetScriptHandler returns a script's record and the paths of its files
+func GetScriptHandler(w http.ResponseWriter, r *http.Request) {
+	script, err := db.GetScriptByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "script not found", http.StatusNotFound)
+		return
+	}
+
+	files, err := storage.Files(script.ID, script.Revision)
+	if err != nil {
+		http.Error(w, "failed to list script files", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ScriptDetail{Script: *script, Files: files}); err != nil {
+		http.Error(w, "failed to encode script", http.StatusInternalServerError)
+		return
+	}
+}
+
+// ListRevisionsHandler lists a script's revisions, newest first
+func ListRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	script, err := db.GetScriptByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "script not found", http.StatusNotFound)
+		return
+	}
+
+	revisions, err := db.ListScriptRevisions(script.ID)
+	if err != nil {
+		http.Error(w, "failed to list revisions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(revisions); err != nil {
+		http.Error(w, "failed to encode revisions", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetRevisionHandler returns one revision of a script and its files
+func GetRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	script, err := db.GetScriptByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "script not found", http.StatusNotFound)
+		return
+	}
+	rev, ok := findRevision(w, script, chi.URLParam(r, "revision"))
+	if !ok {
+		return
+	}
+
+	files, err := storage.Files(script.ID, rev.Revision)
+	if err != nil {
+		http.Error(w, "failed to list script files", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(RevisionDetail{ScriptRevision: *rev, Files: files}); err != nil {
+		http.Error(w, "failed to encode revision", http.StatusInternalServerError)
+		return
+	}
+}
+
+// GetScriptContentHandler returns the source of a script's entrypoint, or
+// of another of its files named with ?path=, from its latest revision or
+// the one given with ?revision=
+func GetScriptContentHandler(w http.ResponseWriter, r *http.Request) {
+	script, err := db.GetScriptByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "script not found", http.StatusNotFound)
+		return
+	}
+	rev, ok := lookupRevision(w, r, script)
+	if !ok {
+		return
+	}
+
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		name = rev.Entrypoint
+	}
+	file, err := storage.File(script.ID, rev.Revision, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, "failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, path.Base(name), info.ModTime(), f)
+}
+
+// UpdateScriptHandler stores a new revision of a script, taking the same
+// form as UploadScript. The script keeps its ID and earlier revisions stay
+// as they were.
+func UpdateScriptHandler(w http.ResponseWriter, r *http.Request) {
+	script, err := db.GetScriptByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "script not found", http.StatusNotFound)
+		return
+	}
+	if script.DeletedAt != "" {
+		http.Error(w, "script has been deleted", http.StatusGone)
+		return
+	}
+
+	upload, meta, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	defer upload.Discard()
+	defer r.MultipartForm.RemoveAll()
+
+	meta.ID = script.ID
+	updated, err := upload.Revise(meta)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+
+	resp := UploadResponse{ScriptID: updated.ID, Entrypoint: updated.Entrypoint, Runtime: updated.Runtime, Revision: updated.Revision}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// DeleteScriptHandler deletes a script. One that jobs refer to is only
+// marked deleted, so their records still say what ran; it can no longer be
+// run or updated.
+func DeleteScriptHandler(w http.ResponseWriter, r *http.Request) {
+	script, err := db.GetScriptByID(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "script not found", http.StatusNotFound)
+		return
+	}
+
+	n, err := db.CountJobsForScript(script.ID)
+	if err != nil {
+		http.Error(w, "failed to delete script", http.StatusInternalServerError)
+		return
+	}
+
+	soft := n > 0
+	if soft {
+		if script.DeletedAt == "" {
+			err = db.SoftDeleteScript(script.ID, time.Now().UTC().Format(time.RFC3339))
+		}
+	} else {
+		if err = db.DeleteScript(script.ID); err == nil {
+			err = storage.Remove(script.ID)
+		}
+	}
+	if err != nil {
+		http.Error(w, "failed to delete script", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"script_id":    script.ID,
+		"soft_deleted": soft,
+	}); err != nil {
+		http.Error(w, "failed to encode response", http.StatusInternalServerError)
+		return
+	}
+}
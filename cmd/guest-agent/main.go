@@ -0,0 +1,231 @@
+// guest-agent runs inside each microVM. The init script starts it once the
+// guest is booted; it waits for the host on vsock, answering health checks
+// while the VM is parked in a warm pool and taking on a fresh identity
+// when it is restored from a snapshot, runs the job it is sent and reboots
+// the guest when the host acknowledges the result.
+//
+// Build it statically for the rootfs:
+//
+//	CGO_ENABLED=0 go build -o rootfs/bin/guest-agent ./cmd/guest-agent
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mdlayher/vsock"
+	"github.com/steveoni/microvm/agent"
+)
+
+func main() {
+	log.SetPrefix("guest-agent: ")
+
+	l, err := vsock.Listen(agent.Port, nil)
+	if err != nil {
+		log.Fatalf("failed to listen on vsock port %d: %v", agent.Port, err)
+	}
+	log.Printf("listening on vsock port %d", agent.Port)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatalf("failed to accept host connection: %v", err)
+		}
+
+		c := agent.NewConn(conn)
+		t, payload, err := c.Recv()
+		if err != nil {
+			log.Printf("failed to read from host: %v", err)
+			conn.Close()
+			continue
+		}
+		if t == agent.FramePing || t == agent.FrameWarmup || t == agent.FrameIdentity {
+			if err := prepare(t, payload); err != nil {
+				log.Printf("failed to prepare guest: %v", err)
+				c.Send(agent.FrameError, []byte(err.Error()))
+			} else {
+				c.Send(agent.FrameAck, nil)
+			}
+			conn.Close()
+			continue
+		}
+
+		l.Close()
+		serve(c, t, payload)
+		conn.Close()
+		break
+	}
+
+	// Firecracker has no ACPI; a reboot is what makes the VMM exit
+	syscall.Sync()
+	if err := syscall.Reboot(syscall.LINUX_REBOOT_CMD_RESTART); err != nil {
+		log.Fatalf("failed to reboot: %v", err)
+	}
+}
+
+// serve handles a single host session that opened with frame t
+func serve(c *agent.Conn, t agent.FrameType, payload []byte) {
+	if t != agent.FrameSpec {
+		log.Printf("expected job spec, got frame %q", t)
+		return
+	}
+
+	var spec agent.Spec
+	if err := json.Unmarshal(payload, &spec); err != nil {
+		c.Send(agent.FrameError, []byte(fmt.Sprintf("invalid job spec: %v", err)))
+	} else if exit, err := run(c, spec); err != nil {
+		c.Send(agent.FrameError, []byte(err.Error()))
+	} else {
+		c.SendJSON(agent.FrameExit, exit)
+	}
+
+	// Hold the VM until the host has collected everything
+	for {
+		t, _, err := c.Recv()
+		if err != nil {
+			log.Printf("host went away: %v", err)
+			return
+		}
+		if t == agent.FrameShutdown {
+			c.Send(agent.FrameAck, nil)
+			return
+		}
+	}
+}
+
+// run unpacks the job's files and executes its command, streaming output
+// back to the host
+func run(c *agent.Conn, spec agent.Spec) (*agent.Exit, error) {
+	if len(spec.Command) == 0 {
+		return nil, fmt.Errorf("job spec has no command")
+	}
+	if err := os.MkdirAll(spec.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", spec.Dir, err)
+	}
+	if spec.Drive != "" {
+		if err := unpackDrive(spec.Drive, spec.Dir); err != nil {
+			return nil, fmt.Errorf("failed to unpack %s: %v", spec.Drive, err)
+		}
+	}
+	if spec.InlineFiles {
+		files := c.Reader(agent.FrameFiles)
+		err := unpack(files, spec.Dir)
+		// The archive's padding follows its end marker
+		if _, derr := io.Copy(io.Discard, files); err == nil {
+			err = derr
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to unpack job files: %v", err)
+		}
+	}
+	if spec.OutDir != "" {
+		if err := os.MkdirAll(spec.OutDir, 0777); err != nil {
+			return nil, fmt.Errorf("failed to create %s: %v", spec.OutDir, err)
+		}
+	}
+
+	args := append(spec.Command[1:], spec.Args...)
+	cmd := exec.Command(spec.Command[0], args...)
+	cmd.Dir = spec.Dir
+	cmd.Env = os.Environ()
+	for k, v := range spec.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdin = bytes.NewReader(spec.Stdin)
+	cmd.Stdout = c.Writer(agent.FrameStdout)
+	cmd.Stderr = c.Writer(agent.FrameStderr)
+
+	err := cmd.Run()
+	if cmd.ProcessState == nil {
+		// Never started, e.g. the interpreter is missing
+		return nil, err
+	}
+
+	exit := &agent.Exit{Code: exitStatus(cmd.ProcessState)}
+	exit.UserCPU = cmd.ProcessState.UserTime()
+	exit.SystemCPU = cmd.ProcessState.SystemTime()
+	if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		exit.MaxRSSKB = ru.Maxrss
+	}
+
+	// The artifacts go out before the exit report so the host has them all
+	// by the time it learns the job is over
+	if spec.OutDir != "" {
+		skipped, err := agent.PackDir(c.Writer(agent.FrameArtifact), spec.OutDir, spec.MaxOutBytes)
+		if err != nil {
+			log.Printf("failed to send artifacts: %v", err)
+		}
+		exit.Skipped = skipped
+	}
+	return exit, nil
+}
+
+// unpackDrive extracts the tar archive written by the host onto a raw
+// block device. The archive's end-of-archive marker stops the reader
+// before the zero padding of the device.
+func unpackDrive(device, dir string) error {
+	f, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return unpack(f, dir)
+}
+
+// unpack extracts a tar archive of the job's files into dir
+func unpack(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, hdr.Name)
+		if target != dir && !strings.HasPrefix(target, dir+string(os.PathSeparator)) {
+			return fmt.Errorf("entry %q escapes %s", hdr.Name, dir)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(hdr.Mode)&0777)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// exitStatus mirrors the shell convention of 128+N for a signal death
+func exitStatus(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"unsafe"
+
+	"github.com/steveoni/microvm/agent"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// prepare handles a request that comes before the job: a health check, a
+// warmup command or a new identity
+func prepare(t agent.FrameType, payload []byte) error {
+	switch t {
+	case agent.FrameWarmup:
+		var command []string
+		if err := json.Unmarshal(payload, &command); err != nil {
+			return fmt.Errorf("invalid warmup command: %v", err)
+		}
+		return warmup(command)
+	case agent.FrameIdentity:
+		var id agent.Identity
+		if err := json.Unmarshal(payload, &id); err != nil {
+			return fmt.Errorf("invalid identity: %v", err)
+		}
+		return assume(id)
+	}
+	return nil
+}
+
+// warmup runs command to completion with its output on the console. It
+// runs before the guest is snapshotted, so whatever it pulls into memory
+// is already there for every guest restored from the snapshot.
+func warmup(command []string) error {
+	if len(command) == 0 {
+		return fmt.Errorf("warmup command is empty")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("warmup command %q: %v", command, err)
+	}
+	return nil
+}
+
+// assume takes on id: the clock is set first, so nothing run afterwards
+// sees the time the snapshot was made
+func assume(id agent.Identity) error {
+	tv := unix.NsecToTimeval(id.Time.UnixNano())
+	if err := unix.Settimeofday(&tv); err != nil {
+		return fmt.Errorf("failed to set clock: %v", err)
+	}
+	if err := reseed(id.Seed); err != nil {
+		return fmt.Errorf("failed to reseed RNG: %v", err)
+	}
+	if id.Address != "" {
+		if err := configureNetwork(id); err != nil {
+			return fmt.Errorf("failed to configure eth0: %v", err)
+		}
+	}
+	log.Printf("assumed new identity %s (%s)", id.Address, id.MAC)
+	return nil
+}
+
+// reseed credits seed to the kernel's entropy pool and forces the CRNG to
+// reseed from it, so restored guests stop generating the same numbers
+func reseed(seed []byte) error {
+	f, err := os.OpenFile("/dev/urandom", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// struct rand_pool_info { int entropy_count; int buf_size; __u32 buf[]; }
+	info := make([]byte, 8+len(seed))
+	binary.NativeEndian.PutUint32(info[0:], uint32(len(seed)*8))
+	binary.NativeEndian.PutUint32(info[4:], uint32(len(seed)))
+	copy(info[8:], seed)
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.RNDADDENTROPY, uintptr(unsafe.Pointer(&info[0]))); errno != 0 {
+		return errno
+	}
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), unix.RNDRESEEDCRNG, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// configureNetwork replaces eth0's MAC, address and default route with
+// those of id
+func configureNetwork(id agent.Identity) error {
+	mac, err := net.ParseMAC(id.MAC)
+	if err != nil {
+		return err
+	}
+	addr, err := netlink.ParseAddr(id.Address)
+	if err != nil {
+		return err
+	}
+	gw := net.ParseIP(id.Gateway)
+	if gw == nil {
+		return fmt.Errorf("invalid gateway %q", id.Gateway)
+	}
+
+	link, err := netlink.LinkByName("eth0")
+	if err != nil {
+		return err
+	}
+	if err := netlink.LinkSetDown(link); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetHardwareAddr(link, mac); err != nil {
+		return err
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return err
+		}
+	}
+	if err := netlink.AddrAdd(link, addr); err != nil {
+		return err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return err
+	}
+	// Taking the link down dropped its routes
+	return netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: gw})
+}
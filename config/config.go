@@ -1 +1,168 @@
 package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds service-wide settings. Every value can be overridden from the
+// environment so the service can be tuned without a rebuild.
+type Config struct {
+	// JobTimeout is how long a job's VM may run before it is forcibly
+	// stopped, unless the run asks for a different timeout.
+	JobTimeout time.Duration
+
+	// MaxJobTimeout is the longest timeout a run may ask for.
+	MaxJobTimeout time.Duration
+
+	// MemoryMB and VCPUs size a job's VM unless the run asks otherwise.
+	MemoryMB int64
+	VCPUs    int64
+
+	// MinMemoryMB, MaxMemoryMB and MaxVCPUs bound what a run may ask for.
+	MinMemoryMB int64
+	MaxMemoryMB int64
+	MaxVCPUs    int64
+
+	// MaxArtifactsMB bounds the files a job may hand back through $OUT_DIR.
+	MaxArtifactsMB int64
+
+	// Runner selects the sandbox backend: "firecracker" for microVMs or
+	// "local" for plain subprocesses on machines without KVM.
+	Runner string
+
+	// GuestSubnet is the IPv4 CIDR guest addresses are leased from. The
+	// first host address is given to the bridge.
+	GuestSubnet string
+
+	// RuntimesFile optionally adds runtimes to the built-in sh and python
+	// ones, as a JSON array.
+	RuntimesFile string
+
+	// StateDir holds runtime state that must survive a restart, such as
+	// the guest address leases.
+	StateDir string
+
+	// PoolSize is how many VMs of the default shape are kept booted for
+	// jobs to claim; 0 disables the default warm pool.
+	PoolSize int64
+
+	// PoolsFile optionally adds warm pools of other shapes, as a JSON
+	// array.
+	PoolsFile string
+
+	// PoolHealthInterval is how often VMs parked in a warm pool are
+	// checked on.
+	PoolHealthInterval time.Duration
+
+	// Snapshots makes VMs restore from a snapshot of a booted guest, kept
+	// under StateDir, instead of booting.
+	Snapshots bool
+
+	// Cgroup is the cgroup v2 group every VMM gets a group of its own in,
+	// which its job's resource usage is read from.
+	Cgroup string
+
+	// Jailer starts every VMM under Firecracker's jailer, chrooted in
+	// JailerChrootDir as JailerUID and JailerGID, with its CPU and memory
+	// limited by its cgroup.
+	Jailer          bool
+	JailerBin       string
+	JailerChrootDir string
+	JailerUID       int64
+	JailerGID       int64
+}
+
+// C is the active configuration, populated by Load.
+var C = Default()
+
+// Default returns the built-in configuration.
+func Default() Config {
+	return Config{
+		JobTimeout:     5 * time.Minute,
+		MaxJobTimeout:  30 * time.Minute,
+		MemoryMB:       128,
+		VCPUs:          1,
+		MinMemoryMB:    64,
+		MaxMemoryMB:    2048,
+		MaxVCPUs:       4,
+		MaxArtifactsMB: 100,
+		Runner:         "firecracker",
+		GuestSubnet:    "192.168.100.0/24",
+		StateDir:       "vm/state",
+
+		PoolHealthInterval: 30 * time.Second,
+		Cgroup:             "microvm",
+
+		JailerBin:       "jailer",
+		JailerChrootDir: "/srv/jailer",
+		JailerUID:       10000,
+		JailerGID:       10000,
+	}
+}
+
+// Load reads overrides from the environment on top of the defaults.
+func Load() Config {
+	cfg := Default()
+	cfg.JobTimeout = durationEnv("MICROVM_JOB_TIMEOUT", cfg.JobTimeout)
+	cfg.MaxJobTimeout = durationEnv("MICROVM_MAX_JOB_TIMEOUT", cfg.MaxJobTimeout)
+	cfg.MemoryMB = intEnv("MICROVM_MEMORY_MB", cfg.MemoryMB)
+	cfg.VCPUs = intEnv("MICROVM_VCPUS", cfg.VCPUs)
+	cfg.MinMemoryMB = intEnv("MICROVM_MIN_MEMORY_MB", cfg.MinMemoryMB)
+	cfg.MaxMemoryMB = intEnv("MICROVM_MAX_MEMORY_MB", cfg.MaxMemoryMB)
+	cfg.MaxVCPUs = intEnv("MICROVM_MAX_VCPUS", cfg.MaxVCPUs)
+	cfg.MaxArtifactsMB = intEnv("MICROVM_MAX_ARTIFACTS_MB", cfg.MaxArtifactsMB)
+	cfg.Runner = stringEnv("MICROVM_RUNNER", cfg.Runner)
+	cfg.GuestSubnet = stringEnv("MICROVM_GUEST_SUBNET", cfg.GuestSubnet)
+	cfg.StateDir = stringEnv("MICROVM_STATE_DIR", cfg.StateDir)
+	cfg.RuntimesFile = stringEnv("MICROVM_RUNTIMES_FILE", cfg.RuntimesFile)
+	cfg.PoolSize = intEnv("MICROVM_POOL_SIZE", cfg.PoolSize)
+	cfg.PoolsFile = stringEnv("MICROVM_POOLS_FILE", cfg.PoolsFile)
+	cfg.PoolHealthInterval = durationEnv("MICROVM_POOL_HEALTH_INTERVAL", cfg.PoolHealthInterval)
+	cfg.Snapshots = boolEnv("MICROVM_SNAPSHOTS", cfg.Snapshots)
+	cfg.Cgroup = stringEnv("MICROVM_CGROUP", cfg.Cgroup)
+	cfg.Jailer = boolEnv("MICROVM_JAILER", cfg.Jailer)
+	cfg.JailerBin = stringEnv("MICROVM_JAILER_BIN", cfg.JailerBin)
+	cfg.JailerChrootDir = stringEnv("MICROVM_JAILER_CHROOT_DIR", cfg.JailerChrootDir)
+	cfg.JailerUID = intEnv("MICROVM_JAILER_UID", cfg.JailerUID)
+	cfg.JailerGID = intEnv("MICROVM_JAILER_GID", cfg.JailerGID)
+	C = cfg
+	return cfg
+}
+
+func stringEnv(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func intEnv(key string, def int64) int64 {
+	if v, err := strconv.ParseInt(os.Getenv(key), 10, 64); err == nil {
+		return v
+	}
+	return def
+}
+
+func boolEnv(key string, def bool) bool {
+	if v, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return v
+	}
+	return def
+}
+
+// durationEnv parses a duration such as "90s" or a plain number of seconds.
+func durationEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return d
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	return def
+}
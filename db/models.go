@@ -2,6 +2,10 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -11,8 +15,51 @@ type Job struct {
 	ScriptID   string
 	Status     string
 	LogPath    string
+	TaskID     string
 	StartedAt  string
 	FinishedAt string
+	ExitCode   *int
+
+	// ScriptRevision is the revision of the script the job runs, 0 for
+	// jobs from before scripts had revisions
+	ScriptRevision int
+
+	// Resources the job's VM was given
+	MemoryMB       int64
+	VCPUs          int64
+	TimeoutSeconds int64
+	Network        bool
+	KernelArgs     string
+	// AllowGuestTraffic lets the guest reach other guests
+	AllowGuestTraffic bool
+
+	// How the script was called, without its secret environment
+	Args  []string
+	Env   map[string]string
+	Stdin string
+
+	// Labels tag the job for finding it with ListJobs
+	Labels map[string]string
+
+	// Usage is what the job's VM consumed on the host, nil until the job
+	// finishes and for runs that weren't accounted
+	Usage *Usage
+
+	// VMMMetrics is the summary of what the job VM's Firecracker reported
+	// about it, kept as the JSON the runner produced; nil like Usage
+	VMMMetrics json.RawMessage
+}
+
+// Usage is the host resources a job's VM consumed from when the job
+// started, not counting what a warm VM used before it was claimed
+type Usage struct {
+	CPUSeconds      float64
+	PeakMemoryBytes int64
+	BlockReadBytes  int64
+	BlockWriteBytes int64
+	// NetRxBytes and NetTxBytes are received and sent by the guest
+	NetRxBytes int64
+	NetTxBytes int64
 }
 
 var DB *sql.DB
@@ -34,16 +81,157 @@ func InitDB(path string) error {
 		finished_at TEXT
 	);
 	`
-	_, err = DB.Exec(schema)
+	if _, err = DB.Exec(schema); err != nil {
+		return err
+	}
+	if _, err = DB.Exec(scriptsSchema); err != nil {
+		return err
+	}
+
+	// Columns added after the initial schema; existing databases are
+	// upgraded in place
+	columns := []struct{ name, decl string }{
+		{"exit_code", "INTEGER"},
+		{"task_id", "TEXT"},
+		{"memory_mb", "INTEGER"},
+		{"vcpus", "INTEGER"},
+		{"timeout_seconds", "INTEGER"},
+		{"network", "INTEGER"},
+		{"kernel_args", "TEXT"},
+		{"args", "TEXT"},
+		{"env", "TEXT"},
+		{"stdin", "TEXT"},
+		{"script_revision", "INTEGER"},
+		{"labels", "TEXT"},
+		{"cpu_seconds", "REAL"},
+		{"peak_memory_bytes", "INTEGER"},
+		{"block_read_bytes", "INTEGER"},
+		{"block_write_bytes", "INTEGER"},
+		{"net_rx_bytes", "INTEGER"},
+		{"net_tx_bytes", "INTEGER"},
+		{"vmm_metrics", "TEXT"},
+		{"allow_guest_traffic", "INTEGER"},
+	}
+	for _, c := range columns {
+		if err := addColumn("jobs", c.name, c.decl); err != nil {
+			return err
+		}
+	}
+	if _, err = DB.Exec(jobIndexes); err != nil {
+		return err
+	}
+	if _, err = DB.Exec(jobTimesUTC); err != nil {
+		return err
+	}
+	if err := addColumn("scripts", "deleted_at", "TEXT"); err != nil {
+		return err
+	}
+	if err := addColumn("scripts", "revision", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+	if _, err = DB.Exec(scriptTimesUTC); err != nil {
+		return err
+	}
+	// Scripts from before revisions become their own first revision
+	_, err = DB.Exec(`INSERT OR IGNORE INTO script_revisions (` + revisionColumns + `)
+		SELECT id, revision, filename, entrypoint, runtime, size, checksum, uploaded_at FROM scripts`)
+	return err
+}
+
+// jobIndexes back the filters and orders of ListJobs. Labels are kept as
+// JSON on the job for reading it back, and a row per label for searching.
+const jobIndexes = `
+	CREATE INDEX IF NOT EXISTS jobs_started_at ON jobs (started_at, id);
+	CREATE INDEX IF NOT EXISTS jobs_finished_at ON jobs (finished_at, id);
+	CREATE INDEX IF NOT EXISTS jobs_script_id ON jobs (script_id, started_at);
+	CREATE INDEX IF NOT EXISTS jobs_status ON jobs (status, started_at);
+
+	CREATE TABLE IF NOT EXISTS job_labels (
+		job_id TEXT,
+		key TEXT,
+		value TEXT,
+		PRIMARY KEY (job_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS job_labels_key_value ON job_labels (key, value);
+	`
+
+// jobTimesUTC brings the times of jobs recorded before they were kept in
+// UTC into it, so they compare as text, and clears the empty finished_at
+// running jobs used to get
+const jobTimesUTC = `
+	UPDATE jobs SET finished_at = NULL WHERE finished_at = '';
+	UPDATE jobs SET started_at = COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', started_at), started_at)
+		WHERE started_at NOT LIKE '%Z';
+	UPDATE jobs SET finished_at = COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', finished_at), finished_at)
+		WHERE finished_at NOT LIKE '%Z';
+	`
+
+// addColumn adds a column to table unless it already exists
+func addColumn(table, column, decl string) error {
+	rows, err := DB.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, typ        string
+			dflt             sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = DB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
 	return err
 }
 
 func InsertJob(j Job) error {
-	_, err := DB.Exec(
-		"INSERT INTO jobs (id, script_id, status, log_path, started_at) VALUES (?, ?, ?, ?, ?)",
-		j.ID, j.ScriptID, j.Status, j.LogPath, j.StartedAt,
+	args, err := json.Marshal(j.Args)
+	if err != nil {
+		return err
+	}
+	env, err := json.Marshal(j.Env)
+	if err != nil {
+		return err
+	}
+	labels, err := json.Marshal(j.Labels)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO jobs (id, script_id, script_revision, status, log_path, task_id, started_at,
+			memory_mb, vcpus, timeout_seconds, network, kernel_args, allow_guest_traffic, args, env, stdin, labels)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		j.ID, j.ScriptID, j.ScriptRevision, j.Status, j.LogPath, j.TaskID, j.StartedAt,
+		j.MemoryMB, j.VCPUs, j.TimeoutSeconds, j.Network, j.KernelArgs, j.AllowGuestTraffic,
+		string(args), string(env), j.Stdin, string(labels),
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	for k, v := range j.Labels {
+		if _, err := tx.Exec("INSERT INTO job_labels (job_id, key, value) VALUES (?, ?, ?)", j.ID, k, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func UpdateJobStatus(id string, status string, finishedAt string) error {
@@ -54,12 +242,250 @@ func UpdateJobStatus(id string, status string, finishedAt string) error {
 	return err
 }
 
+// Reasons StartJob leaves a job alone
+var (
+	ErrJobCancelled  = errors.New("job was cancelled before it started")
+	ErrJobNotPending = errors.New("job has already started")
+)
+
+// StartJob marks a pending job as running. A job asked to cancel while it
+// was queued gets ErrJobCancelled, and one that has started, including one
+// cancelling since, ErrJobNotPending.
+func StartJob(id string) error {
+	res, err := DB.Exec("UPDATE jobs SET status = 'running' WHERE id = ? AND status = 'pending'", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	var status string
+	if err := DB.QueryRow("SELECT status FROM jobs WHERE id = ?", id).Scan(&status); err != nil {
+		return err
+	}
+	if status == "cancel_requested" {
+		return ErrJobCancelled
+	}
+	return ErrJobNotPending
+}
+
+// RequestJobCancel moves a pending job to cancel_requested and a running
+// one to cancelling, and reports whether it did; a job that has already
+// finished is left alone. Keeping the two apart tells a task delivered
+// again whether the job it carries ever started.
+func RequestJobCancel(id string) (bool, error) {
+	res, err := DB.Exec(
+		`UPDATE jobs SET status = CASE status WHEN 'pending' THEN 'cancel_requested' ELSE 'cancelling' END
+			WHERE id = ? AND status IN ('pending', 'running')`,
+		id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// FinishJob records the final status of a job together with the script's
+// exit code, which is nil when the guest never reported one
+func FinishJob(id string, status string, finishedAt string, exitCode *int) error {
+	_, err := DB.Exec(
+		"UPDATE jobs SET status = ?, finished_at = ?, exit_code = ? WHERE id = ?",
+		status, finishedAt, exitCode, id,
+	)
+	return err
+}
+
+// RecordJobUsage stores what a job's VM consumed
+func RecordJobUsage(id string, u Usage) error {
+	_, err := DB.Exec(
+		`UPDATE jobs SET cpu_seconds = ?, peak_memory_bytes = ?, block_read_bytes = ?, block_write_bytes = ?,
+			net_rx_bytes = ?, net_tx_bytes = ? WHERE id = ?`,
+		u.CPUSeconds, u.PeakMemoryBytes, u.BlockReadBytes, u.BlockWriteBytes,
+		u.NetRxBytes, u.NetTxBytes, id,
+	)
+	return err
+}
+
+// RecordJobVMMMetrics stores the JSON summary of a job's VMM metrics
+func RecordJobVMMMetrics(id string, metrics json.RawMessage) error {
+	_, err := DB.Exec("UPDATE jobs SET vmm_metrics = ? WHERE id = ?", string(metrics), id)
+	return err
+}
+
+const jobColumns = `id, script_id, COALESCE(script_revision, 0), status, log_path, COALESCE(task_id, ''), started_at,
+		COALESCE(finished_at, ''), exit_code, COALESCE(memory_mb, 0), COALESCE(vcpus, 0),
+		COALESCE(timeout_seconds, 0), COALESCE(network, 0), COALESCE(kernel_args, ''), COALESCE(allow_guest_traffic, 0),
+		COALESCE(args, 'null'), COALESCE(env, 'null'), COALESCE(stdin, ''), COALESCE(labels, 'null'),
+		cpu_seconds, COALESCE(peak_memory_bytes, 0), COALESCE(block_read_bytes, 0), COALESCE(block_write_bytes, 0),
+		COALESCE(net_rx_bytes, 0), COALESCE(net_tx_bytes, 0), COALESCE(vmm_metrics, 'null')`
+
 func GetJobByID(id string) (*Job, error) {
-	row := DB.QueryRow("SELECT id, script_id, status, log_path, started_at, finished_at FROM jobs WHERE id = ?", id)
+	return scanJob(DB.QueryRow("SELECT "+jobColumns+" FROM jobs WHERE id = ?", id))
+}
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
 	var job Job
-	err := row.Scan(&job.ID, &job.ScriptID, &job.Status, &job.LogPath, &job.StartedAt, &job.FinishedAt)
+	var exitCode sql.NullInt64
+	var args, env, labels, metrics string
+	var cpuSeconds sql.NullFloat64
+	var usage Usage
+	err := row.Scan(&job.ID, &job.ScriptID, &job.ScriptRevision, &job.Status, &job.LogPath, &job.TaskID, &job.StartedAt,
+		&job.FinishedAt, &exitCode, &job.MemoryMB, &job.VCPUs,
+		&job.TimeoutSeconds, &job.Network, &job.KernelArgs, &job.AllowGuestTraffic,
+		&args, &env, &job.Stdin, &labels,
+		&cpuSeconds, &usage.PeakMemoryBytes, &usage.BlockReadBytes, &usage.BlockWriteBytes,
+		&usage.NetRxBytes, &usage.NetTxBytes, &metrics)
 	if err != nil {
 		return nil, err
 	}
+	// Usage is recorded all at once, so CPU time stands for all of it
+	if cpuSeconds.Valid {
+		usage.CPUSeconds = cpuSeconds.Float64
+		job.Usage = &usage
+	}
+	if metrics != "null" {
+		job.VMMMetrics = json.RawMessage(metrics)
+	}
+	if err := json.Unmarshal([]byte(args), &job.Args); err != nil {
+		return nil, fmt.Errorf("invalid args for job %s: %w", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(env), &job.Env); err != nil {
+		return nil, fmt.Errorf("invalid env for job %s: %w", job.ID, err)
+	}
+	if err := json.Unmarshal([]byte(labels), &job.Labels); err != nil {
+		return nil, fmt.Errorf("invalid labels for job %s: %w", job.ID, err)
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		job.ExitCode = &code
+	}
 	return &job, nil
 }
+
+// Orders ListJobs can sort by
+const (
+	SortStartedAt  = "started_at"
+	SortFinishedAt = "finished_at"
+)
+
+// JobFilter narrows ListJobs; zero fields match everything. Times are
+// compared as stored, so they must be RFC 3339 in UTC. After bounds are
+// inclusive and Before bounds exclusive.
+type JobFilter struct {
+	ScriptID       string
+	Statuses       []string
+	StartedAfter   string
+	StartedBefore  string
+	FinishedAfter  string
+	FinishedBefore string
+	// Labels must all be set on a job, with these values
+	Labels map[string]string
+
+	// SortBy is SortStartedAt or SortFinishedAt, with ties broken by ID.
+	// Jobs that haven't finished sort as if they finished first.
+	SortBy string
+	Desc   bool
+	// After continues a listing from the last job of a previous page
+	After *JobCursor
+	Limit int
+}
+
+// JobCursor is where a page of ListJobs ended: the sort value and ID of
+// its last job
+type JobCursor struct {
+	Value string
+	ID    string
+}
+
+// Cursor returns the JobCursor continuing after j in a listing sorted by
+// sortBy
+func (j *Job) Cursor(sortBy string) JobCursor {
+	if sortBy == SortFinishedAt {
+		return JobCursor{Value: j.FinishedAt, ID: j.ID}
+	}
+	return JobCursor{Value: j.StartedAt, ID: j.ID}
+}
+
+// ListJobs returns the jobs matching f in the order it asks for
+func ListJobs(f JobFilter) ([]Job, error) {
+	sortCol := "started_at"
+	if f.SortBy == SortFinishedAt {
+		sortCol = "finished_at"
+	}
+
+	query := "SELECT " + jobColumns + " FROM jobs WHERE 1 = 1"
+	var args []interface{}
+	if f.ScriptID != "" {
+		query += " AND script_id = ?"
+		args = append(args, f.ScriptID)
+	}
+	if len(f.Statuses) > 0 {
+		query += " AND status IN (?" + strings.Repeat(", ?", len(f.Statuses)-1) + ")"
+		for _, s := range f.Statuses {
+			args = append(args, s)
+		}
+	}
+	for _, b := range []struct{ cond, value string }{
+		{"started_at >= ?", f.StartedAfter},
+		{"started_at < ?", f.StartedBefore},
+		{"finished_at >= ?", f.FinishedAfter},
+		{"finished_at < ?", f.FinishedBefore},
+	} {
+		if b.value != "" {
+			query += " AND " + b.cond
+			args = append(args, b.value)
+		}
+	}
+	for k, v := range f.Labels {
+		query += " AND EXISTS (SELECT 1 FROM job_labels l WHERE l.job_id = jobs.id AND l.key = ? AND l.value = ?)"
+		args = append(args, k, v)
+	}
+
+	dir, cmp := "ASC", ">"
+	if f.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if f.After != nil {
+		// A job that hasn't finished has a NULL finished_at, which sorts
+		// before any time and never compares equal
+		switch {
+		case f.SortBy == SortFinishedAt && f.After.Value == "":
+			cond := "finished_at IS NULL AND id " + cmp + " ?"
+			if !f.Desc {
+				cond += " OR finished_at IS NOT NULL"
+			}
+			query += " AND (" + cond + ")"
+			args = append(args, f.After.ID)
+		default:
+			cond := fmt.Sprintf("%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?)", sortCol, cmp)
+			if f.SortBy == SortFinishedAt && f.Desc {
+				cond += " OR finished_at IS NULL"
+			}
+			query += " AND (" + cond + ")"
+			args = append(args, f.After.Value, f.After.Value, f.After.ID)
+		}
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s", sortCol, dir, dir)
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// openTestDB gives the test an empty in-memory database of its own
+func openTestDB(t *testing.T) {
+	t.Helper()
+	name := strings.NewReplacer("/", "_", " ", "_").Replace(t.Name())
+	if err := InitDB(fmt.Sprintf("file:%s?mode=memory&cache=shared", name)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+}
+
+// seedJobs inserts j0..j5 started an hour apart. Even ones have finished,
+// j0 and j4 at the same time; odd ones are still running.
+func seedJobs(t *testing.T) {
+	t.Helper()
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("j%d", i)
+		j := Job{
+			ID:        id,
+			ScriptID:  fmt.Sprintf("s%d", i%2),
+			Status:    "running",
+			StartedAt: fmt.Sprintf("2025-06-12T1%d:00:00Z", i),
+		}
+		if i == 2 {
+			j.Labels = map[string]string{"team": "data", "env": "prod"}
+		}
+		if i == 4 {
+			j.Labels = map[string]string{"team": "data"}
+		}
+		if err := InsertJob(j); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 0 {
+			finished := fmt.Sprintf("2025-06-13T0%d:00:00Z", i%4)
+			if err := FinishJob(id, "succeeded", finished, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func ids(jobs []Job) string {
+	var s []string
+	for _, j := range jobs {
+		s = append(s, j.ID)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestListJobsFilters(t *testing.T) {
+	openTestDB(t)
+	seedJobs(t)
+
+	tests := []struct {
+		name   string
+		filter JobFilter
+		want   string
+	}{
+		{"all newest first", JobFilter{Desc: true}, "j5 j4 j3 j2 j1 j0"},
+		{"script", JobFilter{ScriptID: "s1"}, "j1 j3 j5"},
+		{"statuses", JobFilter{Statuses: []string{"succeeded", "failed"}}, "j0 j2 j4"},
+		{"started window", JobFilter{StartedAfter: "2025-06-12T11:00:00Z", StartedBefore: "2025-06-12T13:00:00Z"}, "j1 j2"},
+		{"finished after", JobFilter{FinishedAfter: "2025-06-13T01:00:00Z"}, "j2"},
+		{"finished before", JobFilter{FinishedBefore: "2025-06-13T01:00:00Z"}, "j0 j4"},
+		{"label", JobFilter{Labels: map[string]string{"team": "data"}}, "j2 j4"},
+		{"labels all match", JobFilter{Labels: map[string]string{"team": "data", "env": "prod"}}, "j2"},
+		{"label value", JobFilter{Labels: map[string]string{"team": "web"}}, ""},
+		{"limit", JobFilter{Limit: 2}, "j0 j1"},
+		{"finished order", JobFilter{SortBy: SortFinishedAt}, "j1 j3 j5 j0 j4 j2"},
+		{"finished order desc", JobFilter{SortBy: SortFinishedAt, Desc: true}, "j2 j4 j0 j5 j3 j1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.filter.SortBy == "" {
+				tt.filter.SortBy = SortStartedAt
+			}
+			jobs, err := ListJobs(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ids(jobs); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListJobsPaging(t *testing.T) {
+	openTestDB(t)
+	seedJobs(t)
+
+	tests := []struct {
+		sortBy string
+		desc   bool
+		want   string
+	}{
+		{SortStartedAt, false, "j0 j1 j2 j3 j4 j5"},
+		{SortStartedAt, true, "j5 j4 j3 j2 j1 j0"},
+		// Pages break between unfinished jobs, and between the two that
+		// finished at the same time
+		{SortFinishedAt, false, "j1 j3 j5 j0 j4 j2"},
+		{SortFinishedAt, true, "j2 j4 j0 j5 j3 j1"},
+	}
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 4} {
+			t.Run(fmt.Sprintf("%s desc %v limit %d", tt.sortBy, tt.desc, limit), func(t *testing.T) {
+				f := JobFilter{SortBy: tt.sortBy, Desc: tt.desc, Limit: limit}
+				var all []Job
+				for page := 0; ; page++ {
+					if page > 6 {
+						t.Fatal("paging doesn't end")
+					}
+					jobs, err := ListJobs(f)
+					if err != nil {
+						t.Fatal(err)
+					}
+					all = append(all, jobs...)
+					if len(jobs) < limit {
+						break
+					}
+					c := jobs[len(jobs)-1].Cursor(tt.sortBy)
+					f.After = &c
+				}
+				if got := ids(all); got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestJobTimesUTC(t *testing.T) {
+	openTestDB(t)
+	InsertJob(Job{ID: "old", Status: "running", StartedAt: "2025-06-12T22:39:10+01:00"})
+	DB.Exec("UPDATE jobs SET finished_at = '' WHERE id = 'old'")
+	InsertJob(Job{ID: "done", Status: "running", StartedAt: "2025-06-12T08:00:00-05:00"})
+	FinishJob("done", "succeeded", "2025-06-12T08:30:00-05:00", nil)
+
+	if _, err := DB.Exec(jobTimesUTC); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id, started, finished string
+	}{
+		{"old", "2025-06-12T21:39:10Z", ""},
+		{"done", "2025-06-12T13:00:00Z", "2025-06-12T13:30:00Z"},
+	}
+	for _, tt := range tests {
+		j, err := GetJobByID(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j.StartedAt != tt.started || j.FinishedAt != tt.finished {
+			t.Errorf("%s: got %q and %q, want %q and %q", tt.id, j.StartedAt, j.FinishedAt, tt.started, tt.finished)
+		}
+	}
+	// An unfinished job is kept NULL, which is what sorting relies on
+	jobs, err := ListJobs(JobFilter{SortBy: SortFinishedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(jobs); got != "old done" {
+		t.Errorf("got %q, want unfinished first", got)
+	}
+}
+
+func TestStartJob(t *testing.T) {
+	openTestDB(t)
+
+	tests := []struct {
+		id       string
+		started  bool
+		cancel   bool
+		want     error
+		wantStat string
+	}{
+		{"queued", false, false, nil, "running"},
+		{"cancelled while queued", false, true, ErrJobCancelled, "cancel_requested"},
+		{"running", true, false, ErrJobNotPending, "running"},
+		// A task delivered again once the job is being cancelled must not
+		// take it for one that never started
+		{"cancelled while running", true, true, ErrJobNotPending, "cancelling"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			if err := InsertJob(Job{ID: tt.id, Status: "pending", StartedAt: "2025-06-12T10:00:00Z"}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.started {
+				if err := StartJob(tt.id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.cancel {
+				if ok, err := RequestJobCancel(tt.id); !ok || err != nil {
+					t.Fatalf("cancel: %v, %v", ok, err)
+				}
+			}
+			if err := StartJob(tt.id); err != tt.want {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+			j, err := GetJobByID(tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if j.Status != tt.wantStat {
+				t.Errorf("status %q, want %q", j.Status, tt.wantStat)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package db
+
+import "database/sql"
+
+// Script is an uploaded script. Its files live in storage under its ID,
+// one immutable tree per revision. The fields describing the files are
+// those of the latest revision.
+type Script struct {
+	ID string
+	// Revision is the number of the latest revision, counting from 1
+	Revision int
+	// Filename is what was uploaded: the script, or the bundle archive
+	Filename   string
+	Entrypoint string
+	Runtime    string
+	// Size is the total size of the script's files and Checksum the
+	// sha256 of their sha256sum listing
+	Size       int64
+	Checksum   string
+	Owner      string
+	UploadedAt string
+	// DeletedAt is set once a script that jobs still refer to is deleted
+	DeletedAt string
+}
+
+const scriptsSchema = `
+	CREATE TABLE IF NOT EXISTS scripts (
+		id TEXT PRIMARY KEY,
+		filename TEXT,
+		entrypoint TEXT,
+		runtime TEXT,
+		size INTEGER,
+		checksum TEXT,
+		owner TEXT,
+		uploaded_at TEXT
+	);
+
+	CREATE TABLE IF NOT EXISTS script_revisions (
+		script_id TEXT,
+		revision INTEGER,
+		filename TEXT,
+		entrypoint TEXT,
+		runtime TEXT,
+		size INTEGER,
+		checksum TEXT,
+		created_at TEXT,
+		PRIMARY KEY (script_id, revision)
+	);
+	`
+
+// ScriptRevision is one version of a script's files. Revisions are never
+// changed once recorded.
+type ScriptRevision struct {
+	ScriptID   string
+	Revision   int
+	Filename   string
+	Entrypoint string
+	Runtime    string
+	Size       int64
+	Checksum   string
+	CreatedAt  string
+}
+
+// scriptTimesUTC brings the times of scripts recorded before they were
+// kept in UTC into it, so ListScripts orders them as text
+const scriptTimesUTC = `
+	UPDATE scripts SET uploaded_at = COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', uploaded_at), uploaded_at)
+		WHERE uploaded_at NOT LIKE '%Z';
+	UPDATE scripts SET deleted_at = COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', deleted_at), deleted_at)
+		WHERE deleted_at NOT LIKE '%Z';
+	UPDATE script_revisions SET created_at = COALESCE(strftime('%Y-%m-%dT%H:%M:%SZ', created_at), created_at)
+		WHERE created_at NOT LIKE '%Z';
+	`
+
+const scriptColumns = "id, revision, filename, entrypoint, runtime, size, checksum, owner, uploaded_at, COALESCE(deleted_at, '')"
+
+const revisionColumns = "script_id, revision, filename, entrypoint, runtime, size, checksum, created_at"
+
+// ScriptFilter narrows ListScripts; zero fields match everything
+type ScriptFilter struct {
+	Runtime        string
+	Owner          string
+	IncludeDeleted bool
+	Limit          int
+	Offset         int
+}
+
+func scanScript(row interface{ Scan(...interface{}) error }) (*Script, error) {
+	var s Script
+	err := row.Scan(&s.ID, &s.Revision, &s.Filename, &s.Entrypoint, &s.Runtime, &s.Size, &s.Checksum, &s.Owner, &s.UploadedAt, &s.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func scanRevision(row interface{ Scan(...interface{}) error }) (*ScriptRevision, error) {
+	var r ScriptRevision
+	err := row.Scan(&r.ScriptID, &r.Revision, &r.Filename, &r.Entrypoint, &r.Runtime, &r.Size, &r.Checksum, &r.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// InsertScript records a new script together with its first revision
+func InsertScript(s Script) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"INSERT INTO scripts (id, revision, filename, entrypoint, runtime, size, checksum, owner, uploaded_at) VALUES (?, 1, ?, ?, ?, ?, ?, ?, ?)",
+		s.ID, s.Filename, s.Entrypoint, s.Runtime, s.Size, s.Checksum, s.Owner, s.UploadedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if err := insertRevision(tx, s, 1, s.UploadedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertRevision(tx *sql.Tx, s Script, revision int, createdAt string) error {
+	_, err := tx.Exec(
+		"INSERT INTO script_revisions ("+revisionColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		s.ID, revision, s.Filename, s.Entrypoint, s.Runtime, s.Size, s.Checksum, createdAt,
+	)
+	return err
+}
+
+func GetScriptByID(id string) (*Script, error) {
+	return scanScript(DB.QueryRow("SELECT "+scriptColumns+" FROM scripts WHERE id = ?", id))
+}
+
+// AddScriptRevision records s.Revision as a script's latest revision. It
+// fails if that revision already exists.
+func AddScriptRevision(s Script, createdAt string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertRevision(tx, s, s.Revision, createdAt); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE scripts SET revision = ?, filename = ?, entrypoint = ?, runtime = ?, size = ?, checksum = ? WHERE id = ?",
+		s.Revision, s.Filename, s.Entrypoint, s.Runtime, s.Size, s.Checksum, s.ID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func GetScriptRevision(id string, revision int) (*ScriptRevision, error) {
+	return scanRevision(DB.QueryRow("SELECT "+revisionColumns+" FROM script_revisions WHERE script_id = ? AND revision = ?", id, revision))
+}
+
+// ListScriptRevisions returns every revision of a script, newest first
+func ListScriptRevisions(id string) ([]ScriptRevision, error) {
+	rows, err := DB.Query("SELECT "+revisionColumns+" FROM script_revisions WHERE script_id = ? ORDER BY revision DESC", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	revisions := []ScriptRevision{}
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, *r)
+	}
+	return revisions, rows.Err()
+}
+
+// ListScripts returns the scripts matching f, newest first
+func ListScripts(f ScriptFilter) ([]Script, error) {
+	query := "SELECT " + scriptColumns + " FROM scripts WHERE 1 = 1"
+	var args []interface{}
+	if f.Runtime != "" {
+		query += " AND runtime = ?"
+		args = append(args, f.Runtime)
+	}
+	if f.Owner != "" {
+		query += " AND owner = ?"
+		args = append(args, f.Owner)
+	}
+	if !f.IncludeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+	query += " ORDER BY uploaded_at DESC, id"
+	if f.Limit > 0 {
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, f.Limit, f.Offset)
+	}
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scripts := []Script{}
+	for rows.Next() {
+		s, err := scanScript(rows)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, *s)
+	}
+	return scripts, rows.Err()
+}
+
+// CountJobsForScript returns how many jobs ran, or are to run, a script
+func CountJobsForScript(id string) (int, error) {
+	var n int
+	err := DB.QueryRow("SELECT COUNT(*) FROM jobs WHERE script_id = ?", id).Scan(&n)
+	return n, err
+}
+
+// SoftDeleteScript hides a script that jobs still refer to
+func SoftDeleteScript(id, deletedAt string) error {
+	_, err := DB.Exec("UPDATE scripts SET deleted_at = ? WHERE id = ?", deletedAt, id)
+	return err
+}
+
+// DeleteScript removes a script and all of its revisions
+func DeleteScript(id string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM script_revisions WHERE script_id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM scripts WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
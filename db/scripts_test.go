@@ -0,0 +1,52 @@
+package db
+
+import "testing"
+
+func TestScriptTimesUTC(t *testing.T) {
+	openTestDB(t)
+	// Recorded in local time, "east" is the oldest but sorts as the newest
+	// until the times are in UTC
+	InsertScript(Script{ID: "east", UploadedAt: "2025-06-12T07:00:00+03:00"})
+	InsertScript(Script{ID: "west", UploadedAt: "2025-06-12T06:45:00+01:00"})
+	SoftDeleteScript("west", "2025-06-13T08:00:00-04:00")
+	InsertScript(Script{ID: "utc", UploadedAt: "2025-06-12T05:30:00Z"})
+
+	if _, err := DB.Exec(scriptTimesUTC); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		id, uploaded, deleted string
+	}{
+		{"east", "2025-06-12T04:00:00Z", ""},
+		{"west", "2025-06-12T05:45:00Z", "2025-06-13T12:00:00Z"},
+		{"utc", "2025-06-12T05:30:00Z", ""},
+	}
+	for _, tt := range tests {
+		s, err := GetScriptByID(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.UploadedAt != tt.uploaded || s.DeletedAt != tt.deleted {
+			t.Errorf("%s: got %q and %q, want %q and %q", tt.id, s.UploadedAt, s.DeletedAt, tt.uploaded, tt.deleted)
+		}
+		r, err := GetScriptRevision(tt.id, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.CreatedAt != tt.uploaded {
+			t.Errorf("%s: revision created %q, want %q", tt.id, r.CreatedAt, tt.uploaded)
+		}
+	}
+
+	scripts, err := ListScripts(ScriptFilter{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range scripts {
+		got = append(got, s.ID)
+	}
+	if len(got) != 3 || got[0] != "west" || got[1] != "utc" || got[2] != "east" {
+		t.Errorf("got %v, want newest first", got)
+	}
+}
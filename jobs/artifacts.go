@@ -0,0 +1,159 @@
+package jobs
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// maxArtifactFiles bounds how many files a job may hand back
+const maxArtifactFiles = 1000
+
+// ErrArtifactNotFound is returned for a path that isn't one of the job's
+// artifacts
+var ErrArtifactNotFound = errors.New("artifact not found")
+
+// Artifact is a file a job left in its $OUT_DIR
+type Artifact struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// ArtifactDir returns the directory holding a job's artifacts
+func ArtifactDir(jobID string) string {
+	return filepath.Join("artifacts", jobID)
+}
+
+// ListArtifacts returns every artifact of a job, empty if it has none
+func ListArtifacts(jobID string) ([]Artifact, error) {
+	dir := ArtifactDir(jobID)
+	artifacts := []Artifact{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		artifacts = append(artifacts, Artifact{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	return artifacts, err
+}
+
+// ArtifactFile returns the file holding the artifact at name, a slash
+// separated path as listed by ListArtifacts
+func ArtifactFile(jobID, name string) (string, error) {
+	// Cleaning from the root keeps ".." from leaving the job's directory
+	file := filepath.Join(ArtifactDir(jobID), filepath.FromSlash(path.Clean("/"+name)))
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", ErrArtifactNotFound
+	}
+	return file, nil
+}
+
+// artifactSink unpacks the archive a runner sends as it is written
+type artifactSink struct {
+	pw   *io.PipeWriter
+	done chan struct{}
+	err  error
+}
+
+// newArtifactSink starts unpacking into dir, replacing anything left there
+// by an earlier attempt at the job
+func newArtifactSink(dir string, limit int64) *artifactSink {
+	pr, pw := io.Pipe()
+	s := &artifactSink{pw: pw, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		if err := os.RemoveAll(dir); err != nil {
+			s.err = err
+		} else {
+			s.err = extractArtifacts(pr, dir, limit)
+		}
+		// Keep reading a rejected archive so the runner never blocks
+		io.Copy(io.Discard, pr)
+	}()
+	return s
+}
+
+func (s *artifactSink) Write(p []byte) (int, error) {
+	return s.pw.Write(p)
+}
+
+// Close waits for the archive to be unpacked and reports any problem with it
+func (s *artifactSink) Close() error {
+	s.pw.Close()
+	<-s.done
+	return s.err
+}
+
+// extractArtifacts unpacks the regular files of a tar archive into dir. The
+// archive comes from the guest, so every entry is checked against dir and
+// the limits before anything is written.
+func extractArtifacts(r io.Reader, dir string, limit int64) error {
+	tr := tar.NewReader(r)
+	var (
+		files int
+		total int64
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("artifact %q escapes the output directory", hdr.Name)
+		}
+		files++
+		if files > maxArtifactFiles {
+			return fmt.Errorf("more than %d artifacts", maxArtifactFiles)
+		}
+		total += hdr.Size
+		if limit > 0 && total > limit {
+			return fmt.Errorf("artifacts exceed %d bytes", limit)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+}
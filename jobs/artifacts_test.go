@@ -0,0 +1,112 @@
+package jobs
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tarOf builds an archive holding a file with each name
+func tarOf(t *testing.T, names ...string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: 2}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte("ok"))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractArtifacts(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		escapes bool
+		want    []string
+	}{
+		{name: "files", entries: []string{"a.txt", "sub/b.txt"}, want: []string{"a.txt", "sub/b.txt"}},
+		{name: "cleaned", entries: []string{"./a.txt", "sub/../c.txt"}, want: []string{"a.txt", "c.txt"}},
+		{name: "parent", entries: []string{"../evil"}, escapes: true},
+		{name: "nested parent", entries: []string{"sub/../../evil"}, escapes: true},
+		{name: "absolute", entries: []string{"/etc/evil"}, escapes: true},
+		{name: "dotdot", entries: []string{".."}, escapes: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, "out")
+			err := extractArtifacts(tarOf(t, tt.entries...), dir, 0)
+			if tt.escapes {
+				if err == nil || !strings.Contains(err.Error(), "escapes") {
+					t.Fatalf("got %v, want the archive rejected", err)
+				}
+				if _, err := os.Stat(filepath.Join(root, "evil")); err == nil {
+					t.Fatal("file written outside the output directory")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for _, name := range tt.want {
+				if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+					t.Errorf("%s not extracted: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArtifactsLimits(t *testing.T) {
+	if err := extractArtifacts(tarOf(t, "a", "b"), t.TempDir(), 3); err == nil {
+		t.Error("archive over the byte limit accepted")
+	}
+	names := make([]string, maxArtifactFiles+1)
+	for i := range names {
+		names[i] = fmt.Sprintf("f%d", i)
+	}
+	if err := extractArtifacts(tarOf(t, names...), t.TempDir(), 0); err == nil {
+		t.Error("archive over the file limit accepted")
+	}
+}
+
+func TestArtifactFile(t *testing.T) {
+	wd, _ := os.Getwd()
+	t.Cleanup(func() { os.Chdir(wd) })
+	os.Chdir(t.TempDir())
+
+	dir := ArtifactDir("job")
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub", "a.txt"), []byte("ok"), 0644)
+	os.WriteFile("secret", []byte("no"), 0644)
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"sub/a.txt", true},
+		{"/sub/a.txt", true},
+		{"sub/../sub/a.txt", true},
+		{"../../secret", false},
+		{"sub/../../../secret", false},
+		{"sub", false},
+		{"missing", false},
+	}
+	for _, tt := range tests {
+		_, err := ArtifactFile("job", tt.name)
+		if (err == nil) != tt.ok {
+			t.Errorf("ArtifactFile(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package jobs
+
+import (
+	"errors"
+
+	"github.com/steveoni/microvm/db"
+)
+
+// ErrJobFinished is returned when cancelling a job that has already ended
+var ErrJobFinished = errors.New("job has already finished")
+
+// Cancel stops a job. A queued job's task is deleted so it never runs and
+// the job is marked cancelled straight away. A running job's handler is
+// cancelled instead; the runner stops the VM and cleans up, and the handler
+// marks the job cancelled once it has.
+func Cancel(jobID string) error {
+	job, err := db.GetJobByID(jobID)
+	if err != nil {
+		return err
+	}
+
+	ok, err := db.RequestJobCancel(jobID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		if job.Status == "cancelling" || job.Status == "cancel_requested" {
+			return nil
+		}
+		return ErrJobFinished
+	}
+
+	// Deleting fails once a worker has picked the task up
+	if err := Inspector.DeleteTask(defaultQueue, job.TaskID); err == nil {
+		return db.FinishJob(jobID, "cancelled", now(), nil)
+	}
+	return Inspector.CancelProcessing(job.TaskID)
+}
@@ -0,0 +1,79 @@
+package jobs
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Limits on what a run may pass to its script
+const (
+	maxArgs      = 256
+	maxEnvVars   = 256
+	maxArgBytes  = 64 << 10
+	maxStdinSize = 1 << 20
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Invocation is how a job's script is called
+type Invocation struct {
+	Args []string          `json:"args,omitempty"`
+	Env  map[string]string `json:"env,omitempty"`
+	// SecretEnv travels in the task payload to reach the worker but is
+	// left out of the job record
+	SecretEnv map[string]string `json:"secret_env,omitempty"`
+	Stdin     string            `json:"stdin,omitempty"`
+}
+
+// Invocation checks the arguments, environment and stdin of o
+func (o RunOptions) Invocation() (Invocation, error) {
+	inv := Invocation{Args: o.Args, Env: o.Env, SecretEnv: o.SecretEnv, Stdin: o.Stdin}
+
+	if len(inv.Args) > maxArgs {
+		return inv, &ValidationError{"args", fmt.Sprintf("more than %d arguments", maxArgs)}
+	}
+	size := 0
+	for _, a := range inv.Args {
+		size += len(a)
+	}
+	if size > maxArgBytes {
+		return inv, &ValidationError{"args", fmt.Sprintf("longer than %d bytes", maxArgBytes)}
+	}
+
+	if len(inv.Env)+len(inv.SecretEnv) > maxEnvVars {
+		return inv, &ValidationError{"env", fmt.Sprintf("more than %d variables", maxEnvVars)}
+	}
+	for k := range inv.Env {
+		if !envNamePattern.MatchString(k) {
+			return inv, &ValidationError{"env", fmt.Sprintf("%q is not a valid variable name", k)}
+		}
+	}
+	for k := range inv.SecretEnv {
+		if !envNamePattern.MatchString(k) {
+			return inv, &ValidationError{"secret_env", fmt.Sprintf("%q is not a valid variable name", k)}
+		}
+		if _, ok := inv.Env[k]; ok {
+			return inv, &ValidationError{"secret_env", fmt.Sprintf("%q is also set in env", k)}
+		}
+	}
+
+	if len(inv.Stdin) > maxStdinSize {
+		return inv, &ValidationError{"stdin", fmt.Sprintf("larger than %d bytes", maxStdinSize)}
+	}
+	return inv, nil
+}
+
+// environ merges the plain and secret environment for the runner
+func (inv Invocation) environ() map[string]string {
+	if len(inv.Env)+len(inv.SecretEnv) == 0 {
+		return nil
+	}
+	env := make(map[string]string, len(inv.Env)+len(inv.SecretEnv))
+	for k, v := range inv.Env {
+		env[k] = v
+	}
+	for k, v := range inv.SecretEnv {
+		env[k] = v
+	}
+	return env
+}
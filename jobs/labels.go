@@ -0,0 +1,31 @@
+package jobs
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Limits on the labels a run may be tagged with
+const (
+	maxLabels          = 32
+	maxLabelValueBytes = 256
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]{0,62}$`)
+
+// JobLabels checks the labels of o. They are stored on the job for finding it
+// again and never reach the script.
+func (o RunOptions) JobLabels() (map[string]string, error) {
+	if len(o.Labels) > maxLabels {
+		return nil, &ValidationError{"labels", fmt.Sprintf("more than %d labels", maxLabels)}
+	}
+	for k, v := range o.Labels {
+		if !labelKeyPattern.MatchString(k) {
+			return nil, &ValidationError{"labels", fmt.Sprintf("%q is not a valid label key", k)}
+		}
+		if len(v) > maxLabelValueBytes {
+			return nil, &ValidationError{"labels", fmt.Sprintf("value of %q is longer than %d bytes", k, maxLabelValueBytes)}
+		}
+	}
+	return o.Labels, nil
+}
@@ -0,0 +1,93 @@
+package jobs
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/steveoni/microvm/runner"
+)
+
+// Log streams stored for every job, one file each under logs/<job id>/
+const (
+	// StreamOutput is stdout and stderr interleaved in the order printed
+	StreamOutput = "output"
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	// StreamSystem is the runner's own log and the guest boot console
+	StreamSystem = "system"
+	// StreamVMM is the hypervisor's log
+	StreamVMM = "vmm"
+)
+
+// Streams lists every stream in the order they are documented
+var Streams = []string{StreamOutput, StreamStdout, StreamStderr, StreamSystem, StreamVMM}
+
+// LogDir returns the directory holding a job's log streams
+func LogDir(jobID string) string {
+	return filepath.Join("logs", jobID)
+}
+
+// LogFile returns the file holding stream for a job whose logs live at
+// logPath. Jobs that ran before streams were split have a single .log file
+// which is returned for every stream.
+func LogFile(logPath, stream string) (string, error) {
+	if strings.HasSuffix(logPath, ".log") {
+		return logPath, nil
+	}
+	for _, s := range Streams {
+		if s == stream {
+			return filepath.Join(logPath, stream+".log"), nil
+		}
+	}
+	return "", fmt.Errorf("unknown log stream %q", stream)
+}
+
+// jobLogs holds the open stream files of a running job
+type jobLogs struct {
+	files []*os.File
+	out   runner.Output
+}
+
+func openJobLogs(dir string) (*jobLogs, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	l := &jobLogs{}
+	// Appending keeps whatever an earlier attempt at the job logged
+	open := func(stream string) (*os.File, error) {
+		f, err := os.OpenFile(filepath.Join(dir, stream+".log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to open %s log: %w", stream, err)
+		}
+		l.files = append(l.files, f)
+		return f, nil
+	}
+
+	files := make(map[string]*os.File, len(Streams))
+	for _, s := range Streams {
+		f, err := open(s)
+		if err != nil {
+			return nil, err
+		}
+		files[s] = f
+	}
+
+	l.out = runner.Output{
+		Stdout: io.MultiWriter(files[StreamStdout], files[StreamOutput]),
+		Stderr: io.MultiWriter(files[StreamStderr], files[StreamOutput]),
+		System: files[StreamSystem],
+		VMM:    files[StreamVMM],
+	}
+	return l, nil
+}
+
+func (l *jobLogs) Close() {
+	for _, f := range l.files {
+		f.Close()
+	}
+}
@@ -0,0 +1,31 @@
+package jobs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenJobLogsAppends(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "job")
+	for _, line := range []string{"first attempt", "second attempt"} {
+		logs, err := openJobLogs(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintln(logs.out.System, line)
+		fmt.Fprintln(logs.out.Stdout, line)
+		logs.Close()
+	}
+
+	for _, stream := range []string{StreamSystem, StreamStdout, StreamOutput} {
+		b, err := os.ReadFile(filepath.Join(dir, stream+".log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != "first attempt\nsecond attempt\n" {
+			t.Errorf("%s log holds %q", stream, got)
+		}
+	}
+}
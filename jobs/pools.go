@@ -0,0 +1,80 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/steveoni/microvm/config"
+	"github.com/steveoni/microvm/runner"
+	"github.com/steveoni/microvm/runtimes"
+)
+
+// poolSpec is an entry of the pools file. Fields left out take what a run
+// asking for nothing gets; the image is rootfs if given, else that of
+// runtime.
+type poolSpec struct {
+	Name     string `json:"name"`
+	Size     int    `json:"size"`
+	Runtime  string `json:"runtime"`
+	RootFS   string `json:"rootfs"`
+	MemoryMB int64  `json:"memory_mb"`
+	VCPUs    int64  `json:"vcpus"`
+	Network  *bool  `json:"network"`
+}
+
+// Pools returns the warm pools configured: the default pool when
+// config.C.PoolSize is set, then those in config.C.PoolsFile
+func Pools() ([]runner.PoolConfig, error) {
+	var specs []poolSpec
+	if config.C.PoolSize > 0 {
+		specs = append(specs, poolSpec{Name: "default", Size: int(config.C.PoolSize)})
+	}
+	if path := config.C.PoolsFile; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var more []poolSpec
+		if err := json.Unmarshal(data, &more); err != nil {
+			return nil, fmt.Errorf("invalid pools file %s: %w", path, err)
+		}
+		specs = append(specs, more...)
+	}
+
+	pools := make([]runner.PoolConfig, 0, len(specs))
+	for _, spec := range specs {
+		res := DefaultResources()
+		pool := runner.PoolConfig{
+			Name:            spec.Name,
+			Size:            spec.Size,
+			KernelImagePath: kernelImage,
+			RootFSPath:      spec.RootFS,
+			MemSizeMB:       res.MemoryMB,
+			CPUs:            res.VCPUs,
+			EnableNetwork:   res.Network,
+		}
+		if pool.RootFSPath == "" {
+			pool.RootFSPath = defaultRootFS
+			if spec.Runtime != "" {
+				rt, err := runtimes.Get(spec.Runtime)
+				if err != nil {
+					return nil, fmt.Errorf("warm pool %s: %w", spec.Name, err)
+				}
+				pool.RootFSPath = rootFSFor(rt)
+				pool.Warmup = rt.Warmup
+			}
+		}
+		if spec.MemoryMB != 0 {
+			pool.MemSizeMB = spec.MemoryMB
+		}
+		if spec.VCPUs != 0 {
+			pool.CPUs = spec.VCPUs
+		}
+		if spec.Network != nil {
+			pool.EnableNetwork = *spec.Network
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
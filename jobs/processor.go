@@ -2,16 +2,19 @@ package jobs
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/hibiken/asynq"
+	"github.com/steveoni/microvm/config"
 	"github.com/steveoni/microvm/db"
 	"github.com/steveoni/microvm/runner"
+	"github.com/steveoni/microvm/runtimes"
+	"github.com/steveoni/microvm/storage"
 )
 
 const (
@@ -21,55 +24,109 @@ const (
 type RunScriptPayload struct {
 	ScriptID string
 	JobID    string // Add this field
+	// Revision is 0 for tasks queued before scripts had revisions, which
+	// run the latest
+	Revision int
+	// Resources is nil for tasks queued before runs could be sized
+	Resources *Resources
+	// Invocation includes the secret environment, so the payload is only
+	// kept in Redis and never written to the job record
+	Invocation Invocation
 }
 
-var Client *asynq.Client
+// defaultRootFS is booted for runtimes without an image of their own
+const defaultRootFS = "vm/images/rootfs.ext4"
+
+// kernelImage is booted by every job
+const kernelImage = "vm/images/vmlinux"
+
+// rootFSFor returns the image booted for scripts of rt
+func rootFSFor(rt runtimes.Runtime) string {
+	if rt.RootFS != "" {
+		return rt.RootFS
+	}
+	return defaultRootFS
+}
+
+// defaultQueue is the only queue jobs are put on
+const defaultQueue = "default"
+
+var (
+	Client    *asynq.Client
+	Inspector *asynq.Inspector
+)
 
 func InitClient(redisAddr string) error {
 	Client = asynq.NewClient(asynq.RedisClientOpt{Addr: redisAddr})
+	Inspector = asynq.NewInspector(asynq.RedisClientOpt{Addr: redisAddr})
 	return nil
 }
 
-func EnqueueScript(scriptID string) (*asynq.TaskInfo, error) {
+// EnqueueScript records a new job running revision of scriptID with res
+// and inv, tagged with labels, and queues it, returning the job's ID
+func EnqueueScript(scriptID string, revision int, res Resources, inv Invocation, labels map[string]string) (string, error) {
 	jobID := uuid.NewString()
 	payload, err := json.Marshal(RunScriptPayload{
-		ScriptID: scriptID,
-		JobID:    jobID,
+		ScriptID:   scriptID,
+		JobID:      jobID,
+		Revision:   revision,
+		Resources:  &res,
+		Invocation: inv,
 	})
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	// Store job reference BEFORE enqueuing
-	startedAt := time.Now().Format(time.RFC3339)
+	// Store job reference BEFORE enqueuing. The task ID is chosen up front
+	// so the job can find its task again to cancel it.
+	taskID := uuid.NewString()
+	startedAt := now()
 	err = db.InsertJob(db.Job{
 		ID:        jobID,
 		ScriptID:  scriptID,
 		Status:    "pending",
-		LogPath:   filepath.Join("logs", jobID+".log"),
+		LogPath:   LogDir(jobID),
+		TaskID:    taskID,
 		StartedAt: startedAt,
+
+		ScriptRevision: revision,
+		Labels:         labels,
+
+		MemoryMB:       res.MemoryMB,
+		VCPUs:          res.VCPUs,
+		TimeoutSeconds: int64(res.Timeout.Seconds()),
+		Network:        res.Network,
+		KernelArgs:     res.KernelArgs,
+
+		AllowGuestTraffic: res.AllowGuestTraffic,
+
+		Args:  inv.Args,
+		Env:   inv.Env,
+		Stdin: inv.Stdin,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to create job record: %w", err)
+		return "", fmt.Errorf("failed to create job record: %w", err)
 	}
 
 	// Only enqueue after successful database insert
+	// Give the handler room to stop the VM and record the outcome after the
+	// job timeout fires, before asynq gives up on the task
 	task := asynq.NewTask(TypeRunScript, payload)
-	info, err := Client.Enqueue(task)
+	_, err = Client.Enqueue(task,
+		asynq.TaskID(taskID),
+		asynq.Queue(defaultQueue),
+		asynq.Timeout(res.Timeout+time.Minute))
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	// Return the job ID we generated (not the task ID)
-	info.ID = jobID
-	return info, nil
+	return jobID, nil
 }
 
 func NewServer(redisAddr string) *asynq.Server {
 	return asynq.NewServer(asynq.RedisClientOpt{Addr: redisAddr}, asynq.Config{
 		Concurrency: 1,
 		Queues: map[string]int{
-			"default": 10,
+			defaultQueue: 10,
 		},
 		// Enable more verbose logging
 		LogLevel:       asynq.DebugLevel,
@@ -77,51 +134,193 @@ func NewServer(redisAddr string) *asynq.Server {
 	})
 }
 
-func Handler() asynq.Handler {
+// Finished reports whether status is one a job ends in
+func Finished(status string) bool {
+	switch status {
+	case "success", "failed", "timed_out", "cancelled":
+		return true
+	}
+	return false
+}
+
+// Handler processes queued jobs, executing scripts with r
+func Handler(r runner.Runner) asynq.Handler {
 	return asynq.HandlerFunc(func(ctx context.Context, t *asynq.Task) error {
 		switch t.Type() {
 		case TypeRunScript:
 			var payload RunScriptPayload
 			if err := json.Unmarshal(t.Payload(), &payload); err != nil {
-				return err
+				// Without its ID there is no job to mark failed
+				return fmt.Errorf("invalid payload: %v: %w", err, asynq.SkipRetry)
 			}
 
 			jobID := payload.JobID
+			job, err := db.GetJobByID(jobID)
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					return fmt.Errorf("job %s not found: %w", jobID, asynq.SkipRetry)
+				}
+				return err
+			}
+			if job.Status != "pending" && job.Status != "cancel_requested" {
+				// The task was delivered again after the job got going
+				return nil
+			}
+
 			scriptID := payload.ScriptID
-            var scriptPath string
-            for _, ext := range []string{".sh", ".py", ""} {
-                path := filepath.Join("scripts", scriptID+ext)
-                if _, err := os.Stat(path); err == nil {
-                    scriptPath = path
-                    break
-                }
-            }
-            
-            if scriptPath == "" {
-                return fmt.Errorf("script not found: %s", scriptID)
-            }
-
-			logPath := filepath.Join("logs", jobID+".log")
-
-			db.UpdateJobStatus(jobID, "running", "")
+			revision := payload.Revision
+			if revision == 0 {
+				latest, err := db.GetScriptByID(scriptID)
+				if err != nil {
+					return failJob(ctx, jobID, fmt.Errorf("failed to look up script %s: %w", scriptID, err), errors.Is(err, sql.ErrNoRows))
+				}
+				revision = latest.Revision
+			}
+			script, err := db.GetScriptRevision(scriptID, revision)
+			if err != nil {
+				return failJob(ctx, jobID, fmt.Errorf("failed to look up script %s revision %d: %w", scriptID, revision, err), errors.Is(err, sql.ErrNoRows))
+			}
+			rt, err := runtimes.Get(script.Runtime)
+			if err != nil {
+				return failJob(ctx, jobID, fmt.Errorf("script %s: %w", scriptID, err), true)
+			}
 
+			// Only a job this task starts is run, so a task delivered
+			// again, as cancelling a running one does, leaves the job to
+			// the handler that started it
+			switch err := db.StartJob(jobID); {
+			case errors.Is(err, db.ErrJobNotPending):
+				return nil
+			case errors.Is(err, db.ErrJobCancelled):
+				// Cancelled while queued but the task got away
+				if logs, err := openJobLogs(LogDir(jobID)); err == nil {
+					fmt.Fprintln(logs.out.System, "Job cancelled before it started")
+					logs.Close()
+				}
+				if err := db.FinishJob(jobID, "cancelled", now(), nil); err != nil {
+					return err
+				}
+				return fmt.Errorf("job %s: %w", jobID, asynq.SkipRetry)
+			case err != nil:
+				return failJob(ctx, jobID, err, false)
+			}
+
+			logs, err := openJobLogs(LogDir(jobID))
+			if err != nil {
+				// The job is running now, so it can't be picked up again
+				return failJob(ctx, jobID, err, true)
+			}
+			defer logs.Close()
+
+			res := DefaultResources()
+			if payload.Resources != nil {
+				res = *payload.Resources
+			}
 			cfg := runner.VMConfig{
-				KernelImagePath: "vm/images/vmlinux",
-				RootFSPath:      "vm/images/rootfs.ext4",
-				ScriptPath:      scriptPath,
-				LogPath:         logPath,
-				MemSizeMB:       128,
-				CPUs:            1,
-				EnableNetwork:   true,
-			}
-			err := runner.RunInVM(ctx, cfg)
-			status := "success"
+				KernelImagePath:   kernelImage,
+				RootFSPath:        rootFSFor(rt),
+				ScriptDir:         storage.Dir(scriptID, revision),
+				Entrypoint:        script.Entrypoint,
+				Interpreter:       rt.Command,
+				Warmup:            rt.Warmup,
+				MemSizeMB:         res.MemoryMB,
+				CPUs:              res.VCPUs,
+				EnableNetwork:     res.Network,
+				AllowGuestTraffic: res.AllowGuestTraffic,
+				Timeout:           res.Timeout,
+				KernelArgs:        res.KernelArgs,
+				Args:              payload.Invocation.Args,
+				Env:               payload.Invocation.environ(),
+				Stdin:             []byte(payload.Invocation.Stdin),
+				MaxArtifactBytes:  config.C.MaxArtifactsMB << 20,
+			}
+			artifacts := newArtifactSink(ArtifactDir(jobID), cfg.MaxArtifactBytes)
+			out := logs.out
+			out.Artifacts = artifacts
+			result, err := r.Run(ctx, cfg, out)
 			if err != nil {
-				status = "failed"
+				fmt.Fprintf(logs.out.System, "%s runner error: %v\n", r.Name(), err)
+			}
+			if err := artifacts.Close(); err != nil {
+				fmt.Fprintf(logs.out.System, "Failed to collect artifacts: %v\n", err)
 			}
-			return db.UpdateJobStatus(jobID, status, time.Now().Format(time.RFC3339))
+			if err == nil && result.VM != nil {
+				if err := db.RecordJobUsage(jobID, vmUsage(result.VM)); err != nil {
+					fmt.Fprintf(logs.out.System, "Failed to record resource usage: %v\n", err)
+				}
+			}
+			if err == nil && result.Metrics != nil {
+				if err := recordVMMMetrics(jobID, result.Metrics); err != nil {
+					fmt.Fprintf(logs.out.System, "Failed to record VMM metrics: %v\n", err)
+				}
+			}
+			if ctx.Err() == context.Canceled {
+				if job, jerr := db.GetJobByID(jobID); jerr == nil && job.Status == "cancelling" {
+					fmt.Fprintln(logs.out.System, "Job cancelled")
+					return db.FinishJob(jobID, "cancelled", now(), nil)
+				}
+			}
+			status := "failed"
+			var exitCode *int
+			if err == nil {
+				exitCode = result.ExitCode
+				switch {
+				case result.TimedOut:
+					status = "timed_out"
+				case exitCode != nil && *exitCode == 0:
+					status = "success"
+				}
+			}
+			return db.FinishJob(jobID, status, now(), exitCode)
 		default:
 			return fmt.Errorf("unknown task type: %s", t.Type())
 		}
 	})
 }
+
+// vmUsage converts what the runner measured to what is kept on the job
+func vmUsage(u *runner.VMUsage) db.Usage {
+	return db.Usage{
+		CPUSeconds:      u.CPUTime.Seconds(),
+		PeakMemoryBytes: u.PeakMemoryBytes,
+		BlockReadBytes:  u.BlockReadBytes,
+		BlockWriteBytes: u.BlockWriteBytes,
+		NetRxBytes:      u.NetRxBytes,
+		NetTxBytes:      u.NetTxBytes,
+	}
+}
+
+// recordVMMMetrics keeps the summary of the job's VMM metrics on the job
+func recordVMMMetrics(jobID string, m *runner.VMMMetrics) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return db.RecordJobVMMMetrics(jobID, b)
+}
+
+// now is the time as job times are stored, in UTC so they compare as text
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// failJob marks a job that couldn't be run failed, with why in its system
+// log. A permanent failure, or any on the task's last attempt, ends the
+// task; otherwise the job is left pending and the task retried.
+func failJob(ctx context.Context, jobID string, err error, permanent bool) error {
+	if !permanent {
+		retried, _ := asynq.GetRetryCount(ctx)
+		maxRetry, _ := asynq.GetMaxRetry(ctx)
+		if retried < maxRetry {
+			return err
+		}
+	}
+	if logs, lerr := openJobLogs(LogDir(jobID)); lerr == nil {
+		fmt.Fprintf(logs.out.System, "Job failed before it ran: %v\n", err)
+		logs.Close()
+	}
+	if ferr := db.FinishJob(jobID, "failed", now(), nil); ferr != nil {
+		return ferr
+	}
+	return fmt.Errorf("%v: %w", err, asynq.SkipRetry)
+}
@@ -0,0 +1,137 @@
+package jobs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/steveoni/microvm/config"
+)
+
+// maxKernelArgsLen keeps the guest command line well inside Firecracker's
+// 2048 byte limit once the runner's own arguments are added
+const maxKernelArgsLen = 512
+
+// reservedKernelArgs are set by the runner and must not be overridden, the
+// guest can't boot or report back without them
+var reservedKernelArgs = []string{"console", "reboot", "panic", "init", "ip"}
+
+// RunOptions is the optional body of a run request. Zero values fall back
+// to the server defaults.
+type RunOptions struct {
+	MemoryMB       int64  `json:"memory_mb"`
+	VCPUs          int64  `json:"vcpus"`
+	TimeoutSeconds int64  `json:"timeout_seconds"`
+	Network        *bool  `json:"network"`
+	KernelArgs     string `json:"kernel_args"`
+	// AllowGuestTraffic lets a networked guest reach other guests
+	AllowGuestTraffic *bool `json:"allow_guest_traffic"`
+
+	Args []string          `json:"args"`
+	Env  map[string]string `json:"env"`
+	// SecretEnv is passed to the script like Env but never stored
+	SecretEnv map[string]string `json:"secret_env"`
+	Stdin     string            `json:"stdin"`
+
+	Labels map[string]string `json:"labels"`
+}
+
+// Resources is what a job's VM actually gets
+type Resources struct {
+	MemoryMB   int64         `json:"memory_mb"`
+	VCPUs      int64         `json:"vcpus"`
+	Timeout    time.Duration `json:"timeout"`
+	Network    bool          `json:"network"`
+	KernelArgs string        `json:"kernel_args,omitempty"`
+
+	AllowGuestTraffic bool `json:"allow_guest_traffic,omitempty"`
+}
+
+// DefaultResources returns the resources of a run that asks for nothing
+func DefaultResources() Resources {
+	return Resources{
+		MemoryMB: config.C.MemoryMB,
+		VCPUs:    config.C.VCPUs,
+		Timeout:  config.C.JobTimeout,
+		Network:  true,
+	}
+}
+
+// ValidationError reports run options outside the server's limits
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+// Resources applies o on top of the defaults and checks the result against
+// the configured limits
+func (o RunOptions) Resources() (Resources, error) {
+	res := DefaultResources()
+
+	if o.MemoryMB != 0 {
+		if o.MemoryMB < config.C.MinMemoryMB || o.MemoryMB > config.C.MaxMemoryMB {
+			return res, &ValidationError{"memory_mb", fmt.Sprintf("must be between %d and %d", config.C.MinMemoryMB, config.C.MaxMemoryMB)}
+		}
+		res.MemoryMB = o.MemoryMB
+	}
+
+	if o.VCPUs != 0 {
+		if o.VCPUs < 1 || o.VCPUs > config.C.MaxVCPUs {
+			return res, &ValidationError{"vcpus", fmt.Sprintf("must be between 1 and %d", config.C.MaxVCPUs)}
+		}
+		res.VCPUs = o.VCPUs
+	}
+
+	if o.TimeoutSeconds != 0 {
+		// Range check before converting, a huge value overflows a Duration
+		maxSeconds := int64(config.C.MaxJobTimeout / time.Second)
+		if o.TimeoutSeconds < 1 || o.TimeoutSeconds > maxSeconds {
+			return res, &ValidationError{"timeout_seconds", fmt.Sprintf("must be between 1 and %d", maxSeconds)}
+		}
+		res.Timeout = time.Duration(o.TimeoutSeconds) * time.Second
+	}
+
+	if o.Network != nil {
+		res.Network = *o.Network
+	}
+
+	if o.AllowGuestTraffic != nil && *o.AllowGuestTraffic {
+		if !res.Network {
+			return res, &ValidationError{"allow_guest_traffic", "needs network"}
+		}
+		res.AllowGuestTraffic = true
+	}
+
+	if o.KernelArgs != "" {
+		if err := checkKernelArgs(o.KernelArgs); err != nil {
+			return res, err
+		}
+		res.KernelArgs = strings.Join(strings.Fields(o.KernelArgs), " ")
+	}
+
+	return res, nil
+}
+
+func checkKernelArgs(args string) error {
+	if len(args) > maxKernelArgsLen {
+		return &ValidationError{"kernel_args", fmt.Sprintf("longer than %d bytes", maxKernelArgsLen)}
+	}
+	for _, c := range args {
+		if c < ' ' || c > '~' {
+			return &ValidationError{"kernel_args", "must be printable ASCII"}
+		}
+	}
+	for _, arg := range strings.Fields(args) {
+		key, _, _ := strings.Cut(arg, "=")
+		for _, reserved := range reservedKernelArgs {
+			if key == reserved {
+				return &ValidationError{"kernel_args", fmt.Sprintf("%q is set by the runner", reserved)}
+			}
+		}
+	}
+	return nil
+}
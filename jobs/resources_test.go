@@ -0,0 +1,55 @@
+package jobs
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRunOptionsResources(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name  string
+		opts  RunOptions
+		field string // of the ValidationError, empty when valid
+		check func(Resources) bool
+	}{
+		{name: "defaults", check: func(r Resources) bool { return r == DefaultResources() }},
+		{name: "memory", opts: RunOptions{MemoryMB: 256}, check: func(r Resources) bool { return r.MemoryMB == 256 }},
+		{name: "memory too small", opts: RunOptions{MemoryMB: 1}, field: "memory_mb"},
+		{name: "memory too large", opts: RunOptions{MemoryMB: 1 << 20}, field: "memory_mb"},
+		{name: "vcpus", opts: RunOptions{VCPUs: 2}, check: func(r Resources) bool { return r.VCPUs == 2 }},
+		{name: "negative vcpus", opts: RunOptions{VCPUs: -1}, field: "vcpus"},
+		{name: "timeout", opts: RunOptions{TimeoutSeconds: 60}, check: func(r Resources) bool { return r.Timeout == time.Minute }},
+		{name: "negative timeout", opts: RunOptions{TimeoutSeconds: -5}, field: "timeout_seconds"},
+		{name: "timeout too long", opts: RunOptions{TimeoutSeconds: 24 * 3600}, field: "timeout_seconds"},
+		// Converted first, these wrapped around to a short timeout
+		{name: "timeout overflowing", opts: RunOptions{TimeoutSeconds: math.MaxInt64/int64(time.Second) + 1}, field: "timeout_seconds"},
+		{name: "timeout at max int64", opts: RunOptions{TimeoutSeconds: math.MaxInt64}, field: "timeout_seconds"},
+		{name: "no network", opts: RunOptions{Network: &no}, check: func(r Resources) bool { return !r.Network }},
+		{name: "guest traffic", opts: RunOptions{AllowGuestTraffic: &yes}, check: func(r Resources) bool { return r.AllowGuestTraffic }},
+		{name: "guest traffic without network", opts: RunOptions{Network: &no, AllowGuestTraffic: &yes}, field: "allow_guest_traffic"},
+		{name: "kernel args", opts: RunOptions{KernelArgs: " quiet   loglevel=3 "}, check: func(r Resources) bool { return r.KernelArgs == "quiet loglevel=3" }},
+		{name: "reserved kernel arg", opts: RunOptions{KernelArgs: "init=/bin/sh"}, field: "kernel_args"},
+		{name: "unprintable kernel args", opts: RunOptions{KernelArgs: "quiet\n"}, field: "kernel_args"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := tt.opts.Resources()
+			if tt.field != "" {
+				var verr *ValidationError
+				if !errors.As(err, &verr) || verr.Field != tt.field {
+					t.Fatalf("got %v, want a ValidationError for %s", err, tt.field)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.check(res) {
+				t.Errorf("got %+v", res)
+			}
+		})
+	}
+}
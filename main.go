@@ -3,26 +3,88 @@ package main
 import (
 	"context"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/hibiken/asynq"
 	"github.com/steveoni/microvm/api"
+	"github.com/steveoni/microvm/config"
 	"github.com/steveoni/microvm/db"
 	"github.com/steveoni/microvm/jobs"
+	"github.com/steveoni/microvm/runner"
+	"github.com/steveoni/microvm/runtimes"
+	"github.com/steveoni/microvm/storage"
 )
 
 // In main.go
 func main() {
 	// signal.Ignore(syscall.SIGTSTP)
+	config.Load()
+
 	if err := db.InitDB("jobs.db"); err != nil {
 		log.Fatal("DB init failed:", err)
 	}
 
+	if config.C.RuntimesFile != "" {
+		if err := runtimes.LoadFile(config.C.RuntimesFile); err != nil {
+			log.Fatal("Runtimes init failed:", err)
+		}
+	}
+	if err := storage.Init(); err != nil {
+		log.Fatal("Storage init failed:", err)
+	}
+
+	r, err := runner.New(config.C.Runner)
+	if err != nil {
+		log.Fatal("Runner init failed:", err)
+	}
+	// Only microVMs need the host bridge and guest address management
+	if r.Name() == "firecracker" {
+		if err := runner.InitNetwork(config.C.GuestSubnet, filepath.Join(config.C.StateDir, "leases.json")); err != nil {
+			log.Fatal("Network init failed:", err)
+		}
+		if err := runner.EnableCgroups(config.C.Cgroup); err != nil {
+			// The jailer can't run without them; without it, VMs only go
+			// unaccounted
+			if config.C.Jailer {
+				log.Fatal("Cgroup init failed:", err)
+			}
+			log.Printf("Cgroup init failed, VM resource usage will not be recorded: %v", err)
+		}
+		if config.C.Jailer {
+			err := runner.EnableJailer(runner.JailerConfig{
+				Binary:        config.C.JailerBin,
+				ExecFile:      "firecracker",
+				ChrootBaseDir: config.C.JailerChrootDir,
+				UID:           int(config.C.JailerUID),
+				GID:           int(config.C.JailerGID),
+			})
+			if err != nil {
+				log.Fatal("Jailer init failed:", err)
+			}
+		}
+		if config.C.Snapshots {
+			if err := runner.EnableSnapshots(filepath.Join(config.C.StateDir, "snapshots")); err != nil {
+				log.Fatal("Snapshot init failed:", err)
+			}
+		}
+
+		pools, err := jobs.Pools()
+		if err != nil {
+			log.Fatal("Warm pool init failed:", err)
+		}
+		if err := runner.StartPools(pools, config.C.PoolHealthInterval); err != nil {
+			log.Fatal("Warm pool init failed:", err)
+		}
+	}
+	log.Printf("Using %s runner", r.Name())
+
 	if err := jobs.InitClient("localhost:6379"); err != nil {
 		log.Fatal("Redis failed:", err)
 	}
@@ -58,7 +120,7 @@ func main() {
 			}
 		}()
 
-		if err := s.Run(jobs.Handler()); err != nil {
+		if err := s.Run(jobs.Handler(r)); err != nil {
 			if err != asynq.ErrServerClosed {
 				log.Printf("Worker error: %v", err)
 			}
@@ -66,11 +128,16 @@ func main() {
 		close(done)
 	}()
 
-	// Create HTTP server with graceful shutdown
+	// Create HTTP server with graceful shutdown. Requests share a base
+	// context that is cancelled on shutdown so followed logs don't hold
+	// the server open.
+	requestCtx, cancelRequests := context.WithCancel(context.Background())
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: api.NewRouter(),
+		Addr:        ":8080",
+		Handler:     api.NewRouter(),
+		BaseContext: func(net.Listener) context.Context { return requestCtx },
 	}
+	server.RegisterOnShutdown(cancelRequests)
 
 	// Start the server in a goroutine
 	go func() {
@@ -96,5 +163,6 @@ func main() {
 
 	// Wait for goroutines to finish
 	wg.Wait()
+	runner.StopPools()
 	log.Println("All services stopped. Goodbye!")
 }
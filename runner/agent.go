@@ -0,0 +1,167 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	fcvsock "github.com/firecracker-microvm/firecracker-go-sdk/vsock"
+	"github.com/sirupsen/logrus"
+
+	"github.com/steveoni/microvm/agent"
+)
+
+// agentCID is the guest context ID given to every VM's vsock device. CIDs
+// only need to be unique per VMM, and each VM has its own UDS on the host.
+const agentCID = 3
+
+// shutdownAckTimeout bounds how long the guest may take to acknowledge the
+// shutdown request once the job has finished
+const shutdownAckTimeout = 5 * time.Second
+
+// runAgentJob connects to the guest agent through the VM's vsock UDS, runs
+// spec and streams the job's output and artifacts to out. When the spec has
+// InlineFiles set the tree at filesDir is sent along with it. It keeps
+// retrying the connection while the guest boots, until ctx is done.
+func runAgentJob(ctx context.Context, udsPath string, spec agent.Spec, filesDir string, out Output, logger *logrus.Entry) (*agent.Exit, error) {
+	artifacts := out.Artifacts
+	if artifacts == nil {
+		artifacts = io.Discard
+	}
+
+	retry := time.Minute
+	if deadline, ok := ctx.Deadline(); ok {
+		retry = time.Until(deadline)
+	}
+	conn, err := fcvsock.DialContext(ctx, udsPath, agent.Port,
+		fcvsock.WithRetryTimeout(retry),
+		fcvsock.WithLogger(logger))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to guest agent: %w", err)
+	}
+	defer conn.Close()
+	logger.Info("Connected to guest agent")
+
+	// Unblock Recv if the run is cancelled or times out
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	c := agent.NewConn(conn)
+	if err := c.SendJSON(agent.FrameSpec, spec); err != nil {
+		return nil, fmt.Errorf("failed to send job spec: %w", err)
+	}
+	if spec.InlineFiles {
+		if _, err := agent.PackDir(c.Writer(agent.FrameFiles), filesDir, 0); err != nil {
+			return nil, fmt.Errorf("failed to send job files: %w", err)
+		}
+		if err := c.Send(agent.FrameFiles, nil); err != nil {
+			return nil, fmt.Errorf("failed to send job files: %w", err)
+		}
+	}
+
+	var exit *agent.Exit
+	for exit == nil {
+		t, payload, err := c.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("lost connection to guest agent: %w", err)
+		}
+
+		switch t {
+		case agent.FrameStdout:
+			out.Stdout.Write(payload)
+		case agent.FrameStderr:
+			out.Stderr.Write(payload)
+		case agent.FrameArtifact:
+			artifacts.Write(payload)
+		case agent.FrameExit:
+			exit = &agent.Exit{}
+			if err := json.Unmarshal(payload, exit); err != nil {
+				return nil, fmt.Errorf("invalid exit report from guest agent: %w", err)
+			}
+		case agent.FrameError:
+			return nil, fmt.Errorf("guest agent: %s", payload)
+		default:
+			logger.Warnf("Ignoring unexpected frame %q from guest agent", t)
+		}
+	}
+
+	// Ask the guest to power off; failing to get an ack is not fatal since
+	// the VMM is stopped regardless
+	conn.SetDeadline(time.Now().Add(shutdownAckTimeout))
+	if err := c.Send(agent.FrameShutdown, nil); err != nil {
+		logger.Warnf("Failed to request guest shutdown: %v", err)
+		return exit, nil
+	}
+	if t, _, err := c.Recv(); err != nil || t != agent.FrameAck {
+		if err == nil {
+			err = errors.New("unexpected frame")
+		}
+		logger.Warnf("Guest did not acknowledge shutdown: %v", err)
+	}
+	return exit, nil
+}
+
+// pingAgent checks that the guest agent behind udsPath is up and still
+// waiting for a job, retrying the connection until ctx is done
+func pingAgent(ctx context.Context, udsPath string, logger *logrus.Entry) error {
+	return callAgent(ctx, udsPath, agent.FramePing, nil, logger)
+}
+
+// warmAgent has an idle guest run command before it is snapshotted
+func warmAgent(ctx context.Context, udsPath string, command []string, logger *logrus.Entry) error {
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+	return callAgent(ctx, udsPath, agent.FrameWarmup, payload, logger)
+}
+
+// sendIdentity gives a guest restored from a snapshot its own identity
+func sendIdentity(ctx context.Context, udsPath string, id agent.Identity, logger *logrus.Entry) error {
+	payload, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	return callAgent(ctx, udsPath, agent.FrameIdentity, payload, logger)
+}
+
+// callAgent sends an idle guest agent a single request frame and waits for
+// it to be acknowledged, retrying the connection until ctx is done
+func callAgent(ctx context.Context, udsPath string, t agent.FrameType, payload []byte, logger *logrus.Entry) error {
+	retry := time.Minute
+	if deadline, ok := ctx.Deadline(); ok {
+		retry = time.Until(deadline)
+	}
+	conn, err := fcvsock.DialContext(ctx, udsPath, agent.Port,
+		fcvsock.WithRetryTimeout(retry),
+		fcvsock.WithLogger(logger))
+	if err != nil {
+		return fmt.Errorf("failed to connect to guest agent: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c := agent.NewConn(conn)
+	if err := c.Send(t, payload); err != nil {
+		return fmt.Errorf("failed to send frame %q to guest agent: %w", t, err)
+	}
+	reply, msg, err := c.Recv()
+	if err != nil {
+		return fmt.Errorf("guest agent did not answer frame %q: %w", t, err)
+	}
+	switch reply {
+	case agent.FrameAck:
+		return nil
+	case agent.FrameError:
+		return fmt.Errorf("guest agent: %s", msg)
+	}
+	return fmt.Errorf("guest agent answered frame %q with frame %q", t, reply)
+}
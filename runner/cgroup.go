@@ -0,0 +1,257 @@
+package runner
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupControllers are enabled for the VMMs' groups: cpu and memory to
+// account and limit them, io to account their drives
+const cgroupControllers = "+cpu +memory +io"
+
+// usageSampleInterval is how often a running VM's memory is sampled on
+// kernels whose memory.peak can't be reset
+const usageSampleInterval = time.Second
+
+// cgroupParent is the group, under cgroupRoot, each VMM gets a group of its
+// own in; it is empty unless EnableCgroups was called
+var cgroupParent string
+
+// EnableCgroups puts every VMM in a cgroup v2 group of its own under
+// parent, which is what a job's resource usage is read from. Groups left
+// behind by a previous run that crashed are removed, so it must be called
+// before any VM is started.
+func EnableCgroups(parent string) error {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return fmt.Errorf("cgroup v2 is not mounted at %s: %w", cgroupRoot, err)
+	}
+	dir := filepath.Join(cgroupRoot, parent)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("cgroup: %w", err)
+	}
+	for _, d := range []string{cgroupRoot, dir} {
+		err := os.WriteFile(filepath.Join(d, "cgroup.subtree_control"), []byte(cgroupControllers), 0644)
+		if err != nil {
+			return fmt.Errorf("cgroup: failed to enable controllers in %s: %w", d, err)
+		}
+	}
+
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	stale, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cgroup: %w", err)
+	}
+	for _, e := range stale {
+		if !e.IsDir() {
+			continue
+		}
+		logger.Infof("Removing stale cgroup of VM %s", e.Name())
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			logger.Warnf("Failed to remove stale cgroup of VM %s: %v", e.Name(), err)
+		}
+	}
+
+	cgroupParent = parent
+	return nil
+}
+
+// vmmCgroup is the cgroup of VM vmID's VMM
+func vmmCgroup(vmID string) string {
+	return filepath.Join(cgroupRoot, cgroupParent, vmID)
+}
+
+// openCgroup creates the cgroup of VM vmID's VMM and opens it, for the VMM
+// to be started in
+func openCgroup(vmID string) (*os.File, error) {
+	dir := vmmCgroup(vmID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	return f, nil
+}
+
+// usageMeter measures a VM's usage while it runs a job. Counters are read
+// when the job starts and again when the VM stops, so a VM's boot, and its
+// time parked in a warm pool, don't count towards the job it runs.
+type usageMeter struct {
+	cgroup string
+	// netDev is the host end of the guest's network device, if it has one
+	netDev string
+
+	// start holds the counters when the job started
+	start *VMUsage
+	// peakFile is the group's memory.peak, reset when the job started, on
+	// kernels that let it be reset; others have their memory sampled
+	peakFile *os.File
+	// peak is the most memory sampled, read once sampling stops
+	peak int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// startUsageMeter starts measuring the usage of vm, which must have a
+// cgroup
+func startUsageMeter(vm *microVM) (*usageMeter, error) {
+	m := &usageMeter{
+		cgroup: vm.cgroup,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if vm.lease != nil {
+		m.netDev = vm.lease.TapName
+	}
+	start, err := m.counters()
+	if err != nil {
+		return nil, err
+	}
+	m.start = start
+
+	// Since Linux 6.12 writing to memory.peak resets what reads of the same
+	// file return
+	if f, err := os.OpenFile(filepath.Join(m.cgroup, "memory.peak"), os.O_RDWR, 0); err == nil {
+		if _, err := f.WriteString("reset\n"); err == nil {
+			m.peakFile = f
+		} else {
+			f.Close()
+		}
+	}
+	go m.sample()
+	return m, nil
+}
+
+func (m *usageMeter) sample() {
+	defer close(m.done)
+	if m.peakFile != nil {
+		return
+	}
+	ticker := time.NewTicker(usageSampleInterval)
+	defer ticker.Stop()
+	for {
+		if current, err := readCgroupInt(m.cgroup, "memory.current"); err == nil {
+			m.peak = max(m.peak, current)
+		}
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// finish stops measuring and returns what the VM used since the job
+// started. It must be called once the VMM has exited, and before the VM's
+// network is torn down.
+func (m *usageMeter) finish() (*VMUsage, error) {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+
+	u, err := m.counters()
+	if err != nil {
+		if m.peakFile != nil {
+			m.peakFile.Close()
+		}
+		return nil, err
+	}
+	u.CPUTime -= m.start.CPUTime
+	u.BlockReadBytes -= m.start.BlockReadBytes
+	u.BlockWriteBytes -= m.start.BlockWriteBytes
+	u.NetRxBytes -= m.start.NetRxBytes
+	u.NetTxBytes -= m.start.NetTxBytes
+
+	u.PeakMemoryBytes = m.peak
+	if m.peakFile != nil {
+		defer m.peakFile.Close()
+		b, err := io.ReadAll(io.NewSectionReader(m.peakFile, 0, 64))
+		if err != nil {
+			return nil, err
+		}
+		if u.PeakMemoryBytes, err = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// counters reads the VM's CPU time and its block and network bytes so far
+func (m *usageMeter) counters() (*VMUsage, error) {
+	u := &VMUsage{}
+	cpu, err := readCgroupKeys(m.cgroup, "cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	u.CPUTime = time.Duration(cpu["usage_usec"]) * time.Microsecond
+
+	// io.stat has a line per device the group did I/O on
+	blk, err := readCgroupKeys(m.cgroup, "io.stat")
+	if err != nil {
+		return nil, err
+	}
+	u.BlockReadBytes, u.BlockWriteBytes = blk["rbytes"], blk["wbytes"]
+
+	if m.netDev != "" {
+		// The host end receives what the guest sends
+		rx, tx, err := linkBytes(m.netDev)
+		if err != nil {
+			return nil, err
+		}
+		u.NetTxBytes, u.NetRxBytes = int64(rx), int64(tx)
+	}
+	return u, nil
+}
+
+// readCgroupInt reads a cgroup file holding a single number
+func readCgroupInt(dir, name string) (int64, error) {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// readCgroupKeys reads a cgroup file of "key value" or "key=value" fields,
+// summing each key's values over every line
+func readCgroupKeys(dir, name string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.Contains(fields[1], "=") {
+			fields = []string{fields[0] + "=" + fields[1]}
+		}
+		for _, field := range fields {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+				sums[key] += n
+			}
+		}
+	}
+	return sums, scanner.Err()
+}
@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadCgroupKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]int64
+	}{
+		{
+			name:    "cpu.stat",
+			content: "usage_usec 1840000\nuser_usec 1200000\nsystem_usec 640000\n",
+			want:    map[string]int64{"usage_usec": 1840000, "user_usec": 1200000, "system_usec": 640000},
+		},
+		{
+			name: "io.stat summed over devices",
+			content: "254:0 rbytes=20971520 wbytes=4194304 rios=320 wios=64 dbytes=0 dios=0\n" +
+				"254:16 rbytes=1024 wbytes=0 rios=1 wios=0 dbytes=0 dios=0\n",
+			want: map[string]int64{"rbytes": 20972544, "wbytes": 4194304, "rios": 321, "wios": 64, "dbytes": 0, "dios": 0},
+		},
+		{
+			name:    "io.stat of a single key",
+			content: "254:0 rbytes=512\n",
+			want:    map[string]int64{"rbytes": 512},
+		},
+		{
+			name:    "values that aren't numbers",
+			content: "usage_usec 10\nstate max\n",
+			want:    map[string]int64{"usage_usec": 10},
+		},
+		{name: "empty", want: map[string]int64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readCgroupKeys(dir, "stat")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := readCgroupKeys(t.TempDir(), "missing"); err == nil {
+		t.Error("missing file read")
+	}
+}
@@ -0,0 +1,32 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/steveoni/microvm/agent"
+)
+
+// createScriptDrive writes the script's file tree into a raw tar archive at
+// imagePath that is attached to the guest as a block device. The guest
+// agent unpacks it straight from the device, so no filesystem has to be
+// built, mounted or populated on the host and no root privileges are
+// needed. The image is exactly as large as the archive, which tar already
+// pads to whole 512-byte sectors.
+func createScriptDrive(scriptDir, imagePath string) error {
+	out, err := os.OpenFile(imagePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create drive image: %w", err)
+	}
+
+	if _, err := agent.PackDir(out, scriptDir, 0); err != nil {
+		out.Close()
+		os.Remove(imagePath)
+		return fmt.Errorf("failed to write script to drive: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(imagePath)
+		return err
+	}
+	return nil
+}
@@ -2,12 +2,15 @@ package runner
 
 import (
 	"context"
-	"crypto/rand"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -15,435 +18,739 @@ import (
 	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
 	"github.com/google/uuid"
+	"github.com/vishvananda/netlink"
+
+	"github.com/steveoni/microvm/agent"
 )
 
 // VMConfig defines how each Firecracker microVM should be configured
 type VMConfig struct {
 	KernelImagePath string
 	RootFSPath      string
-	ScriptPath      string
-	LogPath         string
-	MemSizeMB       int64
-	CPUs            int64
+	// ScriptDir holds the script's file tree, all of which is shipped to
+	// the guest; Entrypoint is the slash separated path of the file run
+	ScriptDir  string
+	Entrypoint string
+	// Interpreter is the runtime's command; the entrypoint is appended
+	Interpreter []string
+	// Warmup is run in a guest before it is snapshotted
+	Warmup        []string
+	MemSizeMB     int64
+	CPUs          int64
 	EnableNetwork bool
+	// AllowGuestTraffic lets the guest reach other VMs on the bridge
+	AllowGuestTraffic bool
+	// Timeout bounds how long the guest may run before the VMM is killed
+	Timeout time.Duration
+	// KernelArgs are appended to the guest kernel command line
+	KernelArgs string
+	// Args, Env and Stdin are passed to the script
+	Args  []string
+	Env   map[string]string
+	Stdin []byte
+	// MaxArtifactBytes bounds the files collected from $OUT_DIR
+	MaxArtifactBytes int64
 }
 
-// setupNetworking creates and configures a TAP device for VM networking
-func setupNetworking(vmID string, logger *logrus.Entry) (string, error) {
-    tapName := fmt.Sprintf("fc-tap-%s", vmID[:8])
-    
-    // Create TAP device
-    cmd := exec.Command("sudo", "ip", "tuntap", "add", tapName, "mode", "tap")
-    if err := cmd.Run(); err != nil {
-        return "", fmt.Errorf("failed to create TAP device: %w", err)
-    }
-    
-    // Set TAP device up
-    cmd = exec.Command("sudo", "ip", "link", "set", tapName, "up")
-    if err := cmd.Run(); err != nil {
-        return "", fmt.Errorf("failed to set TAP device up: %w", err)
-    }
-    
-    // Find default interface
-    defIface, err := getDefaultInterface()
-    if err != nil {
-        logger.Warnf("Failed to get default interface: %v", err)
-        defIface = "eth0" // Fallback
-    }
-    logger.Infof("Using %s as default interface", defIface)
-    
-    // Create bridge if it doesn't exist
-    bridgeName := "fcbr0"
-    cmd = exec.Command("sudo", "ip", "link", "show", bridgeName)
-    if err := cmd.Run(); err != nil {
-        // Bridge doesn't exist, create it
-        cmd = exec.Command("sudo", "ip", "link", "add", bridgeName, "type", "bridge")
-        if err := cmd.Run(); err != nil {
-            logger.Warnf("Failed to create bridge: %v", err)
-        }
-        
-        // Set bridge up
-        cmd = exec.Command("sudo", "ip", "link", "set", bridgeName, "up")
-        if err := cmd.Run(); err != nil {
-            logger.Warnf("Failed to set bridge up: %v", err)
-        }
-        
-        // Configure bridge IP
-        cmd = exec.Command("sudo", "ip", "addr", "add", "192.168.100.1/24", "dev", bridgeName)
-        if err := cmd.Run(); err != nil {
-            logger.Warnf("Failed to set bridge IP: %v", err)
-        }
-    }
-    
-    // Add TAP to bridge
-    cmd = exec.Command("sudo", "ip", "link", "set", tapName, "master", bridgeName)
-    if err := cmd.Run(); err != nil {
-        logger.Warnf("Failed to add TAP to bridge: %v", err)
-    }
-    
-    // Enable IP forwarding
-    cmd = exec.Command("sudo", "sysctl", "-w", "net.ipv4.ip_forward=1")
-    if err := cmd.Run(); err != nil {
-        logger.Warnf("Failed to enable IP forwarding: %v", err)
-    }
-    
-    // Check if MASQUERADE rule already exists
-    cmd = exec.Command("sudo", "iptables", "-t", "nat", "-C", "POSTROUTING", 
-                     "-s", "192.168.100.0/24", "-o", defIface, "-j", "MASQUERADE")
-    if err := cmd.Run(); err != nil {
-        // Rule doesn't exist, add it
-        cmd = exec.Command("sudo", "iptables", "-t", "nat", "-A", "POSTROUTING", 
-                        "-s", "192.168.100.0/24", "-o", defIface, "-j", "MASQUERADE")
-        if err := cmd.Run(); err != nil {
-            logger.Warnf("Failed to add MASQUERADE rule: %v", err)
-        }
-    }
-    
-    // Allow outgoing traffic from TAP/bridge
-    cmd = exec.Command("sudo", "iptables", "-C", "FORWARD",
-                     "-i", bridgeName, "-o", defIface, "-j", "ACCEPT")
-    if err := cmd.Run(); err != nil {
-        cmd = exec.Command("sudo", "iptables", "-A", "FORWARD",
-                         "-i", bridgeName, "-o", defIface, "-j", "ACCEPT")
-        if err := cmd.Run(); err != nil {
-            logger.Warnf("Failed to add outgoing FORWARD rule: %v", err)
-        }
-    }
-    
-    // Allow established/related traffic back
-    cmd = exec.Command("sudo", "iptables", "-C", "FORWARD",
-                     "-i", defIface, "-o", bridgeName, "-m", "state",
-                     "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-    if err := cmd.Run(); err != nil {
-        cmd = exec.Command("sudo", "iptables", "-A", "FORWARD",
-                         "-i", defIface, "-o", bridgeName, "-m", "state",
-                         "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT")
-        if err := cmd.Run(); err != nil {
-            logger.Warnf("Failed to add incoming FORWARD rule: %v", err)
-        }
-    }
-    
-    logger.Infof("Network bridge %s setup with TAP %s connected to %s", 
-                bridgeName, tapName, defIface)
-    
-    return tapName, nil
+// guestScriptDir is where the guest agent unpacks the script drive
+const guestScriptDir = "/mnt/script"
+
+// guestOutDir is the script's $OUT_DIR, collected once it exits
+const guestOutDir = "/out"
+
+// Firecracker runs each job in a fresh Firecracker microVM
+type Firecracker struct{}
+
+func (Firecracker) Name() string {
+	return "firecracker"
 }
 
-// cleanupNetworking removes network resources
-func cleanupNetworking(tapName string, logger *logrus.Entry) {
-    if tapName == "" {
-        return
-    }
-    
-    // Remove TAP device from bridge
-    cmd := exec.Command("sudo", "ip", "link", "set", tapName, "nomaster")
-    if err := cmd.Run(); err != nil {
-        logger.Warnf("Failed to remove TAP from bridge: %v", err)
-    }
-    
-    // Delete TAP device
-    cmd = exec.Command("sudo", "ip", "link", "delete", tapName)
-    if err := cmd.Run(); err != nil {
-        logger.Warnf("Failed to delete TAP device: %v", err)
-    } else {
-        logger.Infof("Deleted TAP device %s", tapName)
-    }
-    
+func (Firecracker) Run(ctx context.Context, cfg VMConfig, out Output) (*Result, error) {
+	return RunInVM(ctx, cfg, out)
+}
+
+// ipam hands out guest addresses; it is set up once by InitNetwork
+var ipam *IPAM
+
+// InitNetwork prepares the host side of guest networking: the fcbr0 bridge,
+// IP forwarding and the NAT/forward firewall rules, plus guest address
+// management for subnet with leases persisted to statePath. TAP devices
+// left behind by a previous run that crashed are removed and their
+// addresses returned to the pool. The process needs CAP_NET_ADMIN.
+func InitNetwork(subnet, statePath string) error {
+	m, err := NewIPAM(subnet, statePath)
+	if err != nil {
+		return err
+	}
+
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	err = m.Reclaim(func(l Lease) {
+		logger.Infof("Reclaiming stale lease %s (%s) from VM %s", l.IP, l.TapName, l.VMID)
+		cleanupNetworking(l.TapName, logger)
+		deleteNetNS(netNSName(l.VMID), logger)
+	})
+	if err != nil {
+		return err
+	}
+
+	ones, _ := m.Subnet().Mask.Size()
+	bridgeAddr := &net.IPNet{IP: m.Gateway(), Mask: net.CIDRMask(ones, 32)}
+	if _, err := ensureBridge(bridgeName, bridgeAddr); err != nil {
+		return err
+	}
+	if err := enableProxyARP(bridgeName); err != nil {
+		return err
+	}
+	if err := enableIPForward(); err != nil {
+		return err
+	}
+
+	uplink, err := defaultInterface()
+	if err != nil {
+		return err
+	}
+	if err := applyFirewall(m.Subnet(), bridgeName, uplink); err != nil {
+		return err
+	}
+	logger.Infof("Network bridge %s (%s) forwarding through %s", bridgeName, bridgeAddr, uplink)
+
+	ipam = m
+	return nil
 }
 
-// getDefaultInterface finds the default network interface
-func getDefaultInterface() (string, error) {
-    // Get the interface with default route
-    cmd := exec.Command("sh", "-c", "ip route | grep default | cut -d ' ' -f 5")
-    output, err := cmd.Output()
-    if err != nil {
-        return "", err
-    }
-    
-    ifName := strings.TrimSpace(string(output))
-    if ifName == "" {
-        return "", fmt.Errorf("no default interface found")
-    }
-    
-    return ifName, nil
+// leaseNetwork acquires a guest address for vmID and wires up its TAP device
+func leaseNetwork(vmID string, allowPeers bool, logger *logrus.Entry) (*Lease, error) {
+	if ipam == nil {
+		return nil, fmt.Errorf("networking not initialized")
+	}
+
+	lease, err := ipam.Acquire(vmID)
+	if err != nil {
+		return nil, err
+	}
+	if err := setupNetworking(lease, allowPeers, logger); err != nil {
+		releaseNetwork(lease, logger)
+		return nil, err
+	}
+	return lease, nil
 }
 
-// generateRandomMac creates a random MAC address for the VM interface
-func generateRandomMac() string {
-    buf := make([]byte, 6)
-    _, err := rand.Read(buf)
-    if err != nil {
-        // Fallback in case of error
-        return "02:00:00:00:00:01"
-    }
-    
-    // Ensure unicast and locally administered
-    buf[0] = (buf[0] | 2) & 0xfe
-    return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", buf[0], buf[1], buf[2], buf[3], buf[4], buf[5])
+// releaseNetwork tears down the lease's TAP device and frees its address
+func releaseNetwork(lease *Lease, logger *logrus.Entry) {
+	cleanupNetworking(lease.TapName, logger)
+	if err := removePeer(lease.IP); err != nil {
+		logger.Warnf("Failed to remove %s from peers: %v", lease.IP, err)
+	}
+	if err := ipam.Release(lease); err != nil {
+		logger.Warnf("Failed to release lease %s: %v", lease.IP, err)
+	}
 }
 
-func RunInVM(ctx context.Context, cfg VMConfig) error {
-	// Get absolute paths
-	kernelPath, err := filepath.Abs(cfg.KernelImagePath)
+// setupNetworking creates the lease's TAP device as an isolated port on
+// the bridge, so the guest can reach the gateway but not other guests.
+// With allowPeers the guest's address joins the firewall's peers, so it
+// can reach other peers routed through the gateway.
+func setupNetworking(lease *Lease, allowPeers bool, logger *logrus.Entry) error {
+	bridge, err := netlink.LinkByName(bridgeName)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path for kernel: %w", err)
+		return netErr("lookup bridge", bridgeName, err)
 	}
-	rootfsPath, err := filepath.Abs(cfg.RootFSPath)
+
+	tap, err := createTap(lease.TapName, bridge)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path for rootfs: %w", err)
+		return err
+	}
+
+	if err := attachGuestPort(tap, lease.IP, allowPeers); err != nil {
+		return err
+	}
+
+	logger.Infof("TAP %s attached to bridge %s (peers: %t)", lease.TapName, bridgeName, allowPeers)
+	return nil
+}
+
+// cleanupNetworking removes network resources
+func cleanupNetworking(tapName string, logger *logrus.Entry) {
+	if tapName == "" {
+		return
 	}
-	scriptPath, err := filepath.Abs(cfg.ScriptPath)
+
+	// Deleting the device also detaches it from the bridge
+	if err := deleteTap(tapName); err != nil {
+		logger.Warnf("Failed to delete TAP device: %v", err)
+	} else {
+		logger.Infof("Deleted TAP device %s", tapName)
+	}
+}
+
+// RunInVM runs the script in a microVM and blocks until the guest powers
+// itself off or cfg.Timeout elapses, whichever comes first. A VM parked in
+// a warm pool that fits cfg is used if there is one, otherwise a new one
+// is restored from a snapshot or booted. The script's stdout and stderr,
+// the runner log and serial console, and the VMM log are written to their
+// streams in out as they are produced.
+func RunInVM(ctx context.Context, cfg VMConfig, out Output) (*Result, error) {
+	scriptDir, err := filepath.Abs(cfg.ScriptDir)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path for script: %w", err)
+		return nil, fmt.Errorf("failed to get absolute path for script: %w", err)
+	}
+
+	if vm, pool := claimWarm(cfg); vm != nil {
+		vm.system.attach(out.System)
+		vm.vmm.attach(out.VMM)
+		vm.logger.Infof("Claimed VM %s from warm pool %s for script: %s (%s)", vm.id, pool, scriptDir, cfg.Entrypoint)
+		return vm.run(ctx, cfg, scriptDir, out), nil
 	}
-	logPath, err := filepath.Abs(cfg.LogPath)
+
+	system, vmm := newRelay(out.System), newRelay(out.VMM)
+	vm, err := startVM(ctx, cfg, scriptDir, system, vmm)
 	if err != nil {
-		return fmt.Errorf("failed to get absolute path for log: %w", err)
+		return nil, err
 	}
+	vm.logger.Infof("Started VM process for script: %s (%s)", scriptDir, cfg.Entrypoint)
+	return vm.run(ctx, cfg, scriptDir, out), nil
+}
 
-	// Create log directory if it doesn't exist
-	logDir := filepath.Dir(logPath)
-	if err := os.MkdirAll(logDir, 0755); err != nil {
-		return fmt.Errorf("failed to create log directory: %w", err)
+// startVM restores a VM shaped by cfg from its snapshot, falling back to
+// booting one if there is no snapshot yet or the restore fails. A restored
+// VM is sent the job's files with its spec instead of on a drive.
+func startVM(ctx context.Context, cfg VMConfig, scriptDir string, system, vmmLog *relay) (*microVM, error) {
+	if snap := snapshots.lookup(cfg); snap != nil {
+		vm, err := restoreVM(ctx, cfg, snap, system, vmmLog)
+		if err == nil {
+			return vm, nil
+		}
+		snapshotStats.Add("restore_failures", 1)
+		fmt.Fprintf(system, "Failed to restore VM from snapshot %s, booting instead: %v\n", snap.name, err)
 	}
+	return bootVM(ctx, cfg, scriptDir, system, vmmLog, false)
+}
 
-	// Create a unique directory for all VM-related files
+// microVM is a booted guest whose agent is waiting for its job
+type microVM struct {
+	id      string
+	dir     string
+	machine *firecracker.Machine
+	lease   *Lease
+	// netns is the VM's own network namespace, if it has one
+	netns string
+	// jailDir holds the chroot of a jailed VM, which is its dir
+	jailDir string
+	// cgroup is the VMM's cgroup, if cgroups are enabled. The jailer
+	// creates a jailed VMM's; any other VMM is started in cgroupDir.
+	cgroup    string
+	cgroupDir *os.File
+	// relativePaths says the VMM is given paths relative to dir, which it
+	// runs in
+	relativePaths bool
+	// vsockPath is the host side of the guest agent's vsock device
+	vsockPath string
+	// scriptDrive is set when the job's files were attached at boot;
+	// otherwise they are sent to the agent with the spec
+	scriptDrive bool
+
+	logger *logrus.Entry
+	// system and vmm carry the VM's logs to whichever job it runs
+	system *relay
+	vmm    *relay
+	// consoleDone is closed once the VMM log has been read to its end
+	consoleDone chan struct{}
+	// metrics sums what the VMM wrote to its metrics FIFO; metricsDone
+	// is closed once the FIFO has been read to its end, or closed by
+	// destroy
+	metricsMu   sync.Mutex
+	metrics     VMMMetrics
+	metricsFIFO *os.File
+	metricsDone chan struct{}
+
+	destroyOnce sync.Once
+}
+
+// newMicroVM creates the directory of a new VM, which is its chroot when
+// the jailer is enabled
+func newMicroVM(system, vmmLog *relay) (*microVM, error) {
 	vmID := uuid.New().String()
-	vmDir := filepath.Join(os.TempDir(), fmt.Sprintf("fcvm-%s", vmID))
-	if err := os.MkdirAll(vmDir, 0755); err != nil {
-		return fmt.Errorf("failed to create VM directory: %w", err)
+
+	// Logger setup
+	logger := logrus.New()
+	logger.SetOutput(system)
+
+	vm := &microVM{
+		id:          vmID,
+		dir:         filepath.Join(os.TempDir(), fmt.Sprintf("fcvm-%s", vmID)),
+		logger:      logrus.NewEntry(logger),
+		system:      system,
+		vmm:         vmmLog,
+		consoleDone: make(chan struct{}),
+		metricsDone: make(chan struct{}),
+	}
+	if jailer != nil {
+		vm.jailDir = jailer.jailDir(vmID)
+		vm.dir = filepath.Join(vm.jailDir, "root")
+		vm.relativePaths = true
+	}
+	vm.vsockPath = filepath.Join(vm.dir, "vsock.sock")
+
+	if err := os.MkdirAll(vm.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create VM directory: %w", err)
+	}
+	if err := vm.own(vm.dir); err != nil {
+		vm.destroy()
+		return nil, err
+	}
+	if cgroupParent != "" {
+		vm.cgroup = vmmCgroup(vmID)
+		if vm.jailDir == "" {
+			dir, err := openCgroup(vmID)
+			if err != nil {
+				vm.destroy()
+				return nil, err
+			}
+			vm.cgroupDir = dir
+		}
+	}
+	return vm, nil
+}
+
+// vmmPath returns the path the VMM opens the file name in the VM's
+// directory by
+func (vm *microVM) vmmPath(name string) string {
+	if vm.relativePaths {
+		return name
+	}
+	return filepath.Join(vm.dir, name)
+}
+
+// setupNetwork gives the VM its network and returns the TAP device its
+// VMM opens. With ownNS, and always when it is jailed, the VMM gets a
+// network namespace of its own; otherwise the TAP is on the host, and
+// failing to set it up only leaves the VM offline.
+func (vm *microVM) setupNetwork(cfg VMConfig, ownNS bool) (string, error) {
+	ownNS = ownNS || vm.jailDir != ""
+	switch {
+	case cfg.EnableNetwork && ownNS:
+		vm.logger.Info("Setting up network namespace for VM...")
+		lease, netns, err := leaseNetNS(vm.id, cfg.AllowGuestTraffic, vm.logger)
+		if err != nil {
+			return "", fmt.Errorf("failed to setup networking: %w", err)
+		}
+		vm.lease, vm.netns = lease, netns
+		return nsTapName, nil
+	case cfg.EnableNetwork:
+		vm.logger.Info("Setting up networking for VM...")
+		lease, err := leaseNetwork(vm.id, cfg.AllowGuestTraffic, vm.logger)
+		if err != nil {
+			vm.logger.Warnf("Failed to setup networking: %v", err)
+			return "", nil
+		}
+		vm.lease = lease
+		return lease.TapName, nil
+	case ownNS:
+		// An empty namespace keeps a VMM without networking off the host's
+		netns := netNSName(vm.id)
+		ns, err := createNetNS(netns)
+		vm.netns = netns
+		if err != nil {
+			return "", netErr("create netns", netns, err)
+		}
+		ns.Close()
 	}
-	defer os.RemoveAll(vmDir) // Clean up ALL VM files on exit
+	return "", nil
+}
+
+// vmmCommand returns the command starting the VM's VMM in its directory
+// and cgroup, under the jailer if it is enabled. socketPath is where we
+// find the API socket.
+func (vm *microVM) vmmCommand(ctx context.Context, cfg VMConfig, socketPath string) *exec.Cmd {
+	if vm.jailDir != "" {
+		return jailer.command(ctx, vm, cfg)
+	}
+	cmd := firecracker.VMCommandBuilder{}.
+		WithBin("firecracker").
+		WithSocketPath(socketPath).
+		AddArgs("--id", vm.id).
+		WithStdout(vm.system).
+		WithStderr(vm.system).
+		Build(ctx)
+	cmd.Dir = vm.dir
+	if vm.cgroupDir != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			UseCgroupFD: true,
+			CgroupFD:    int(vm.cgroupDir.Fd()),
+		}
+	}
+	return cmd
+}
 
-	// Create socket in VM directory
-	socketPath := filepath.Join(vmDir, "firecracker.sock")
+// machineConfig fills in what every VM's machine is configured with: its
+// API socket, log and metrics FIFOs, and the network namespace the SDK
+// starts the VMM in unless the jailer puts it there
+func (vm *microVM) machineConfig(fcCfg firecracker.Config) firecracker.Config {
+	fcCfg.VMID = vm.id
+	fcCfg.SocketPath = filepath.Join(vm.dir, "firecracker.sock")
+	// The SDK creates the FIFOs at the paths the VMM is given, so they
+	// are only relative for a jailed VMM, whose FIFOs we create
+	fifoDir := vm.dir
+	if vm.jailDir != "" {
+		fifoDir = ""
+	}
+	fcCfg.LogFifo = filepath.Join(fifoDir, "console.fifo")
+	fcCfg.MetricsFifo = filepath.Join(fifoDir, "metrics.fifo")
+	fcCfg.LogLevel = "Debug"
+	if vm.relativePaths {
+		// The SDK would look for the relative paths from our directory
+		fcCfg.DisableValidation = true
+	}
+	if vm.netns != "" && vm.jailDir == "" {
+		fcCfg.NetNS = netNSPath(vm.netns)
+	}
+	return fcCfg
+}
 
-	// Set paths for FIFO files - DO NOT CREATE THEM
-	fifoPath := filepath.Join(vmDir, "console.fifo")
-	metricsPath := filepath.Join(vmDir, "metrics.fifo")
+// machineOpts returns the options the VM's machine is created with; opts
+// go before those adapting it to the jail
+func (vm *microVM) machineOpts(cmd *exec.Cmd, opts ...firecracker.Opt) []firecracker.Opt {
+	opts = append([]firecracker.Opt{
+		firecracker.WithLogger(vm.logger),
+		firecracker.WithProcessRunner(cmd),
+	}, opts...)
+	if vm.jailDir != "" {
+		opts = append(opts, jailedLogFiles(vm))
+	}
+	return opts
+}
 
-	// Open log file
-	logFile, err := os.Create(logPath)
+// bootVM starts a microVM shaped by cfg and returns without waiting for the
+// guest to come up. With a scriptDir the job's files are attached as a
+// drive; without one the VM can take any job that fits its shape. A golden
+// VM is one to be snapshotted: it is networked through a namespace of its
+// own and its devices are given paths relative to its directory, so a VM
+// restored from it can find its own copies. The VMM is killed when ctx is
+// done.
+func bootVM(ctx context.Context, cfg VMConfig, scriptDir string, system, vmmLog *relay, golden bool) (_ *microVM, err error) {
+	// Get absolute paths
+	kernelPath, err := filepath.Abs(cfg.KernelImagePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path for kernel: %w", err)
+	}
+	rootfsPath, err := filepath.Abs(cfg.RootFSPath)
 	if err != nil {
-		return fmt.Errorf("failed to create log file: %w", err)
+		return nil, fmt.Errorf("failed to get absolute path for rootfs: %w", err)
 	}
-	defer logFile.Close() // Safe to defer now as we'll read AFTER VM stops
 
-	// Logger setup
-	logger := logrus.New()
-	logger.SetOutput(logFile)
-	logrusEntry := logrus.NewEntry(logger)
-	logrusEntry.Info("Starting VM process for script:", scriptPath)
+	// Create a unique directory for all VM-related files
+	vm, err := newMicroVM(system, vmmLog)
+	if err != nil {
+		return nil, err
+	}
+	vm.scriptDrive = scriptDir != ""
+	vm.relativePaths = vm.relativePaths || golden
+	logrusEntry := vm.logger
+	// Until the VM is handed back everything it holds is released here
+	defer func() {
+		if err != nil {
+			vm.destroy()
+		}
+	}()
 
 	// Setup networking if enabled
-    var tapName string
-    if cfg.EnableNetwork {
-        logrusEntry.Info("Setting up networking for VM...")
-        var err error
-        tapName, err = setupNetworking(vmID, logrusEntry)
-        if err != nil {
-            logrusEntry.Warnf("Failed to setup networking: %v", err)
-        } else {
-            defer cleanupNetworking(tapName, logrusEntry)
-        }
-    }
+	tapName, err := vm.setupNetwork(cfg, golden)
+	if err != nil {
+		return nil, err
+	}
+
+	if kernelPath, err = vm.expose(kernelPath); err != nil {
+		return nil, fmt.Errorf("failed to add kernel to jail: %w", err)
+	}
+
+	// Give the VM its own copy of the root filesystem so concurrent guests
+	// can't corrupt each other and the base image stays pristine. The copy
+	// lives in the VM's directory and is removed with it.
+	jobRootFS := filepath.Join(vm.dir, "rootfs.ext4")
+	if err := cloneRootFS(rootfsPath, jobRootFS); err != nil {
+		return nil, err
+	}
+	if err := vm.own(jobRootFS); err != nil {
+		return nil, err
+	}
 
 	// Setup drives
 	drives := []models.Drive{
 		{
 			DriveID:      firecracker.String("rootfs"),
-			PathOnHost:   firecracker.String(rootfsPath),
+			PathOnHost:   firecracker.String(vm.vmmPath("rootfs.ext4")),
 			IsRootDevice: firecracker.Bool(true),
 			IsReadOnly:   firecracker.Bool(false),
 		},
 	}
 
-	// Create script drive
-	scriptDrive := filepath.Join(os.TempDir(), fmt.Sprintf("script-%s.ext4", vmID))
-	err = createExt4ImageWithScript(scriptPath, scriptDrive)
-	if err != nil {
-		return fmt.Errorf("failed to create script drive: %w", err)
-	}
-	defer os.Remove(scriptDrive)
-
-	drives = append(drives, models.Drive{
-		DriveID:      firecracker.String("script"),
-		PathOnHost:   firecracker.String(scriptDrive),
-		IsRootDevice: firecracker.Bool(false),
-		IsReadOnly:   firecracker.Bool(true),
-	})
+	if vm.scriptDrive {
+		// Create script drive inside the VM's directory so concurrent jobs
+		// never share it
+		scriptDrive := filepath.Join(vm.dir, "script.tar")
+		if err := createScriptDrive(scriptDir, scriptDrive); err != nil {
+			return nil, fmt.Errorf("failed to create script drive: %w", err)
+		}
+		if err := vm.own(scriptDrive); err != nil {
+			return nil, err
+		}
 
-	machineOpts := []firecracker.Opt{
-		firecracker.WithLogger(logrusEntry),
+		drives = append(drives, models.Drive{
+			DriveID:      firecracker.String("script"),
+			PathOnHost:   firecracker.String(vm.vmmPath("script.tar")),
+			IsRootDevice: firecracker.Bool(false),
+			IsReadOnly:   firecracker.Bool(true),
+		})
 	}
 
+	// Capture the serial console (kernel and init output) ourselves instead
+	// of letting it go to the service's stdout
+	io.WriteString(system, "\n\n===== VM SERIAL CONSOLE =====\n\n")
+	fcCfg := vm.machineConfig(firecracker.Config{})
+	vmmCmd := vm.vmmCommand(ctx, cfg, fcCfg.SocketPath)
+
 	// Configure networking interfaces if enabled
-    var networkInterfaces []firecracker.NetworkInterface
-    kernelArgs := "console=ttyS0 reboot=k panic=1 pci=off init=/init"
-    
-    if cfg.EnableNetwork && tapName != "" {
-        // Generate MAC address for guest
-        guestMac := generateRandomMac()
-        
-        // Add network interface config
-        networkInterfaces = append(networkInterfaces, firecracker.NetworkInterface{
-            StaticConfiguration: &firecracker.StaticNetworkConfiguration{
-                MacAddress:  guestMac,
-                HostDevName: tapName,
-            },
-        })
-        
-        // Modify kernel args to include network config
-        // Configure static IP for predictability
-        kernelArgs += " ip=192.168.100.2::192.168.100.1:255.255.255.0::eth0:off"
-        logrusEntry.Infof("Network interface configured with MAC %s on TAP device %s", 
-                           guestMac, tapName)
-    }
+	var networkInterfaces []firecracker.NetworkInterface
+	kernelArgs := "console=ttyS0 reboot=k panic=1 pci=off init=/init"
+
+	if lease := vm.lease; lease != nil {
+		// Add network interface config
+		networkInterfaces = append(networkInterfaces, firecracker.NetworkInterface{
+			StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+				MacAddress:  lease.MAC,
+				HostDevName: tapName,
+			},
+		})
+
+		// Modify kernel args to include network config
+		// Configure the leased static IP for predictability
+		kernelArgs += fmt.Sprintf(" ip=%s::%s:%s::eth0:off", lease.IP, ipam.Gateway(), ipam.Netmask())
+		logrusEntry.Infof("Network interface configured with IP %s, MAC %s on TAP device %s",
+			lease.IP, lease.MAC, tapName)
+	}
+	if cfg.KernelArgs != "" {
+		kernelArgs += " " + cfg.KernelArgs
+	}
 
 	// Create VM configuration - LET FIRECRACKER CREATE THE FIFO
-	fcCfg := firecracker.Config{
-		SocketPath:      socketPath,
-		KernelImagePath: kernelPath,
-		Drives:          drives,
-		MachineCfg: models.MachineConfiguration{
-			VcpuCount:  firecracker.Int64(cfg.CPUs),
-			MemSizeMib: firecracker.Int64(cfg.MemSizeMB),
-		},
-		JailerCfg:         nil,
-		NetworkInterfaces: networkInterfaces,
-		LogFifo:           fifoPath,
-		MetricsFifo:       metricsPath,
-		LogLevel:          "Debug",
-		KernelArgs:        kernelArgs,
+	fcCfg.KernelImagePath = kernelPath
+	fcCfg.Drives = drives
+	fcCfg.MachineCfg = models.MachineConfiguration{
+		VcpuCount:  firecracker.Int64(cfg.CPUs),
+		MemSizeMib: firecracker.Int64(cfg.MemSizeMB),
+	}
+	fcCfg.NetworkInterfaces = networkInterfaces
+	fcCfg.VsockDevices = []firecracker.VsockDevice{
+		{ID: "agent", Path: vm.vmmPath("vsock.sock"), CID: agentCID},
 	}
+	fcCfg.KernelArgs = kernelArgs
 
 	// Create the VM
-	vm, err := firecracker.NewMachine(ctx, fcCfg, machineOpts...)
+	machine, err := firecracker.NewMachine(ctx, fcCfg, vm.machineOpts(vmmCmd)...)
 	if err != nil {
-		return fmt.Errorf("failed to create VM: %w", err)
+		return nil, fmt.Errorf("failed to create VM: %w", err)
 	}
 
+	vm.machine = machine
+
 	// Start the VM FIRST - this creates the FIFO
 	logrusEntry.Info("Starting VM...")
-	if err := vm.Start(ctx); err != nil {
-		return fmt.Errorf("failed to start VM: %w", err)
+	if err := machine.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to start VM: %w", err)
 	}
 
-	// AFTER VM starts, read from the FIFO in a goroutine
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
+	// AFTER VM starts, read from the FIFOs in goroutines
+	go vm.readLog(filepath.Join(vm.dir, "console.fifo"))
+	vm.readMetrics(filepath.Join(vm.dir, "metrics.fifo"))
+
+	return vm, nil
+}
 
-		// Give Firecracker a moment to create the FIFO
-		time.Sleep(100 * time.Millisecond)
+// readLog copies the VMM log from its FIFO to the VM's vmm relay until
+// the VMM closes it
+func (vm *microVM) readLog(fifoPath string) {
+	defer close(vm.consoleDone)
 
-		// Open FIFO for reading
-		fifo, err := os.Open(fifoPath)
+	// Give Firecracker a moment to create the FIFO
+	time.Sleep(100 * time.Millisecond)
+
+	// Open FIFO for reading
+	fifo, err := os.Open(fifoPath)
+	if err != nil {
+		vm.logger.Errorf("Failed to open FIFO: %v", err)
+		return
+	}
+	defer fifo.Close()
+
+	// Copy output
+	buffer := make([]byte, 4096)
+	for {
+		n, err := fifo.Read(buffer)
+		if n > 0 {
+			vm.vmm.Write(buffer[:n])
+		}
 		if err != nil {
-			logrusEntry.Errorf("Failed to open FIFO: %v", err)
-			return
+			break
 		}
-		defer fifo.Close()
-
-		// Write header and copy output
-		logFile.WriteString("\n\n===== VM CONSOLE OUTPUT =====\n\n")
-		buffer := make([]byte, 4096)
-		for {
-			n, err := fifo.Read(buffer)
-			if n > 0 {
-				logFile.Write(buffer[:n])
-				logFile.Sync() // Flush immediately
-			}
-			if err != nil {
-				break
-			}
+	}
+	vm.logger.Info("Finished reading VM output")
+}
+
+// run drives the job through the guest agent, then stops the VM and
+// releases everything it held. A VM only ever runs one job.
+func (vm *microVM) run(ctx context.Context, cfg VMConfig, scriptDir string, out Output) *Result {
+	defer vm.destroy()
+	logrusEntry := vm.logger
+
+	// For a VM booted for this job the timeout covers the boot as well,
+	// since a guest that never comes up must not hold a worker
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	logrusEntry.Infof("VM started, running job with a %s timeout...", timeout)
+	startedAt := time.Now()
+	result := &Result{}
+	var meter *usageMeter
+	if vm.cgroup != "" {
+		var err error
+		if meter, err = startUsageMeter(vm); err != nil {
+			logrusEntry.Warnf("Failed to read VM resource usage: %v", err)
 		}
-		logrusEntry.Info("Finished reading VM output")
+	}
+
+	runCtx, cancelRun := context.WithTimeout(ctx, timeout)
+	defer cancelRun()
+	// Stop waiting on the agent as soon as the VMM dies
+	go func() {
+		vm.machine.Wait(runCtx)
+		cancelRun()
 	}()
 
-	// Wait for VM execution
-	logrusEntry.Info("VM started, waiting for execution to complete...")
-	time.Sleep(30 * time.Second)
+	spec := agent.Spec{
+		Command:     scriptCommand(cfg.Interpreter, path.Join(guestScriptDir, cfg.Entrypoint)),
+		Args:        cfg.Args,
+		Env:         scriptEnv(cfg.Env, guestOutDir),
+		Dir:         guestScriptDir,
+		Stdin:       cfg.Stdin,
+		OutDir:      guestOutDir,
+		MaxOutBytes: cfg.MaxArtifactBytes,
+	}
+	if vm.scriptDrive {
+		spec.Drive = "/dev/vdb"
+	} else {
+		spec.InlineFiles = true
+	}
+	exit, err := runAgentJob(runCtx, vm.vsockPath, spec, scriptDir, out, logrusEntry)
+	switch {
+	case err == nil:
+		result.ExitCode = &exit.Code
+		result.Usage = &Usage{UserCPU: exit.UserCPU, SystemCPU: exit.SystemCPU, MaxRSSKB: exit.MaxRSSKB}
+		logrusEntry.Infof("Script exited with code %d (user %s, sys %s, max rss %d KiB)",
+			exit.Code, exit.UserCPU, exit.SystemCPU, exit.MaxRSSKB)
+		for _, name := range exit.Skipped {
+			logrusEntry.Warnf("Artifact %s not collected, over the size limit", name)
+		}
+	case runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil:
+		result.TimedOut = true
+		logrusEntry.Warnf("Job did not finish within %s, stopping VM", timeout)
+	case ctx.Err() != nil:
+		logrusEntry.Warn("Job cancelled, stopping VM")
+	default:
+		logrusEntry.Errorf("Job failed: %v", err)
+	}
+	result.Duration = time.Since(startedAt)
+
+	// After acknowledging shutdown the guest reboots, which ends the VMM;
+	// in every other case stop it ourselves
+	if exit == nil {
+		vm.flushMetrics()
+		if err := vm.machine.StopVMM(); err != nil {
+			logrusEntry.Warnf("Error stopping VM: %v", err)
+		}
+	}
+	vm.halt()
 
-	// Stop the VM
-	logrusEntry.Info("Stopping VM...")
-	if err := vm.StopVMM(); err != nil {
-		logrusEntry.Warnf("Error stopping VM: %v", err)
+	if meter != nil {
+		usage, err := meter.finish()
+		if err != nil {
+			logrusEntry.Warnf("Failed to read VM resource usage: %v", err)
+		} else {
+			result.VM = usage
+			logrusEntry.Infof("VM usage: cpu %s, peak memory %d bytes, block read %d written %d bytes, net rx %d tx %d bytes",
+				usage.CPUTime, usage.PeakMemoryBytes, usage.BlockReadBytes, usage.BlockWriteBytes, usage.NetRxBytes, usage.NetTxBytes)
+		}
 	}
 
 	// Wait for output collection to finish
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancelWait()
 	select {
-	case <-done:
+	case <-vm.consoleDone:
 		logrusEntry.Info("Console output captured")
-	case <-time.After(2 * time.Second):
+	case <-waitCtx.Done():
 		logrusEntry.Warn("Timed out waiting for console output")
 	}
-
-	// Explicitly flush log file
-	if err:= logFile.Sync(); err != nil {
-        logrusEntry.Errorf("Failed to flush log file: %v", err)
-    }
-
-	return nil
-}
-
-func createExt4ImageWithScript(scriptPath, imagePath string) error {
-	tmpDir := filepath.Join(os.TempDir(), "vm-script")
-	 if err := os.MkdirAll(tmpDir, 0755); err != nil {
-        return fmt.Errorf("failed to create temp directory: %w", err)
-    }
-	defer func() {
-        if err := os.RemoveAll(tmpDir); err != nil {
-            // Just log this error since we're in a defer
-            fmt.Fprintf(os.Stderr, "warning: failed to remove temp directory: %v\n", err)
-        }
-    }()
-
-	scriptName := filepath.Base(scriptPath)
-	destScriptPath := filepath.Join(tmpDir, scriptName)
-	input, err := os.ReadFile(scriptPath)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(destScriptPath, input, 0755)
-	if err != nil {
-		return err
-	}
-
-	size := "10M"
-	cmd := exec.Command("truncate", "-s", size, imagePath)
-	if err := cmd.Run(); err != nil {
-		return err
+	select {
+	case <-vm.metricsDone:
+	case <-waitCtx.Done():
+		logrusEntry.Warn("Timed out waiting for VMM metrics")
 	}
-
-	cmd = exec.Command("mkfs.ext4", "-F", imagePath)
-	if err := cmd.Run(); err != nil {
-		return err
+	if m := vm.vmmMetrics(); m != nil {
+		result.Metrics = m
+		m.publish()
+		logrusEntry.Infof("VMM metrics captured from %d flushes", m.Flushes)
 	}
 
-	mnt := filepath.Join(os.TempDir(), "mnt-script")
-	if err := os.MkdirAll(mnt, 0755); err != nil {
-        return fmt.Errorf("failed to create mount directory: %w", err)
-    }
-    defer func() {
-        if err := os.RemoveAll(mnt); err != nil {
-            fmt.Fprintf(os.Stderr, "warning: failed to remove mount directory: %v\n", err)
-        }
-    }()
+	return result
+}
 
-	// Mount the filesystem
-	cmd = exec.Command("sudo", "mount", "-o", "loop", imagePath, mnt)
-	if err := cmd.Run(); err != nil {
-		return err
+// halt waits briefly for the VMM to exit, stopping it if it doesn't
+func (vm *microVM) halt() {
+	haltCtx, cancelHalt := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelHalt()
+	if err := vm.machine.Wait(haltCtx); err != nil && haltCtx.Err() != nil {
+		vm.logger.Warn("VM did not halt, stopping it")
+		if err := vm.machine.StopVMM(); err != nil {
+			vm.logger.Warnf("Error stopping VM: %v", err)
+		}
+	} else {
+		vm.logger.Info("VM halted")
 	}
-	defer func() {
-        if err := exec.Command("sudo", "umount", mnt).Run(); err != nil {
-            fmt.Fprintf(os.Stderr, "warning: failed to unmount directory: %v\n", err)
-        }
-    }()
-
+}
 
-	// Copy directly to the root of the ext4 image - REMOVE THE NESTED DIRECTORY
-	cmd = exec.Command("sudo", "cp", destScriptPath, filepath.Join(mnt, scriptName))
-	return cmd.Run()
+// destroy stops the VMM if it is still running and releases the VM's
+// address and files. It is safe to call more than once.
+func (vm *microVM) destroy() {
+	vm.destroyOnce.Do(func() {
+		if vm.machine != nil {
+			if err := vm.machine.StopVMM(); err == nil {
+				vm.halt()
+			}
+		}
+		switch {
+		case vm.lease != nil && vm.netns != "":
+			releaseNetNS(vm.lease, vm.netns, vm.logger)
+		case vm.lease != nil:
+			releaseNetwork(vm.lease, vm.logger)
+		case vm.netns != "":
+			deleteNetNS(vm.netns, vm.logger)
+		}
+		os.RemoveAll(vm.dir) // Clean up ALL VM files on exit
+		if vm.jailDir != "" {
+			// The jailer leaves its directory behind
+			os.RemoveAll(vm.jailDir)
+		}
+		if vm.metricsFIFO != nil {
+			vm.metricsFIFO.Close()
+		}
+		if vm.cgroupDir != nil {
+			vm.cgroupDir.Close()
+		}
+		if vm.cgroup != "" {
+			if err := os.Remove(vm.cgroup); err != nil && !os.IsNotExist(err) {
+				vm.logger.Warnf("Failed to remove cgroup: %v", err)
+			}
+		}
+	})
 }
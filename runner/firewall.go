@@ -0,0 +1,240 @@
+package runner
+
+import (
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// firewallTable is the nftables table owned by the service. It is rebuilt
+// from scratch on every start, so rules never pile up across restarts.
+const firewallTable = "microvm"
+
+// peersSet holds the addresses of guests allowed to reach each other
+const peersSet = "peers"
+
+// applyFirewall installs NAT and forwarding rules so guests on bridge can
+// reach the outside world through uplink, but not each other unless both
+// are in the peers set, nor the host itself, equivalent to:
+//
+//	table ip microvm {
+//		set peers {
+//			type ipv4_addr
+//		}
+//		chain postrouting {
+//			type nat hook postrouting priority srcnat;
+//			ip saddr $subnet oifname $uplink masquerade
+//		}
+//		chain forward {
+//			type filter hook forward priority filter;
+//			iifname $bridge oifname $uplink accept
+//			iifname $uplink oifname $bridge ct state established,related accept
+//			iifname $bridge oifname $bridge ip saddr @peers ip daddr @peers accept
+//			iifname $bridge oifname $bridge drop
+//		}
+//		chain input {
+//			type filter hook input priority filter;
+//			iifname $bridge ct state established,related accept
+//			iifname $bridge drop
+//		}
+//	}
+//
+// Isolated bridge ports keep guests apart on the bridge, and proxy ARP
+// sends whatever they address to each other through the gateway, where
+// the forward rules let it on only between peers. Guests need nothing
+// from the host itself, their DNS goes out through the uplink like the
+// rest of their traffic.
+func applyFirewall(subnet *net.IPNet, bridge, uplink string) error {
+	c, err := nftables.New()
+	if err != nil {
+		return netErr("open nftables", "", err)
+	}
+
+	table := &nftables.Table{Name: firewallTable, Family: nftables.TableFamilyIPv4}
+	// Adding before deleting makes the delete succeed whether or not the
+	// table already existed
+	c.AddTable(table)
+	c.DelTable(table)
+	c.AddTable(table)
+
+	peers := &nftables.Set{Table: table, Name: peersSet, KeyType: nftables.TypeIPAddr}
+	if err := c.AddSet(peers, nil); err != nil {
+		return netErr("add peers set", "", err)
+	}
+
+	post := c.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: post,
+		Exprs: append(append(
+			matchSourceSubnet(subnet),
+			matchIfname(expr.MetaKeyOIFNAME, uplink)...),
+			&expr.Masq{},
+		),
+	})
+
+	fwd := c.AddChain(&nftables.Chain{
+		Name:     "forward",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: fwd,
+		Exprs: append(append(
+			matchIfname(expr.MetaKeyIIFNAME, bridge),
+			matchIfname(expr.MetaKeyOIFNAME, uplink)...),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		),
+	})
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: fwd,
+		Exprs: append(append(append(
+			matchIfname(expr.MetaKeyIIFNAME, uplink),
+			matchIfname(expr.MetaKeyOIFNAME, bridge)...),
+			matchCtState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)...),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		),
+	})
+	// Traffic a guest sends through the gateway to another guest
+	hairpin := func() []expr.Any {
+		return append(
+			matchIfname(expr.MetaKeyIIFNAME, bridge),
+			matchIfname(expr.MetaKeyOIFNAME, bridge)...)
+	}
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: fwd,
+		Exprs: append(append(append(hairpin(),
+			matchAddrInSet(12, peers)...),
+			matchAddrInSet(16, peers)...),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		),
+	})
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: fwd,
+		Exprs: append(hairpin(), &expr.Verdict{Kind: expr.VerdictDrop}),
+	})
+
+	input := c.AddChain(&nftables.Chain{
+		Name:     "input",
+		Table:    table,
+		Type:     nftables.ChainTypeFilter,
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	})
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: input,
+		Exprs: append(append(
+			matchIfname(expr.MetaKeyIIFNAME, bridge),
+			matchCtState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)...),
+			&expr.Verdict{Kind: expr.VerdictAccept},
+		),
+	})
+	c.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: input,
+		Exprs: append(matchIfname(expr.MetaKeyIIFNAME, bridge), &expr.Verdict{Kind: expr.VerdictDrop}),
+	})
+
+	return netErr("apply firewall rules", "", c.Flush())
+}
+
+// addPeer lets the guest at ip reach, and be reached by, other peers
+// through the gateway
+func addPeer(ip net.IP) error {
+	c, peers, err := peersSetConn()
+	if err != nil {
+		return err
+	}
+	if err := c.SetAddElements(peers, []nftables.SetElement{{Key: ip.To4()}}); err != nil {
+		return netErr("add peer", ip.String(), err)
+	}
+	return netErr("add peer", ip.String(), c.Flush())
+}
+
+// removePeer takes ip out of the peers set if it is in it
+func removePeer(ip net.IP) error {
+	c, peers, err := peersSetConn()
+	if err != nil {
+		return err
+	}
+	elems, err := c.GetSetElements(peers)
+	if err != nil {
+		return netErr("list peers", "", err)
+	}
+	for _, e := range elems {
+		if net.IP(e.Key).Equal(ip) {
+			if err := c.SetDeleteElements(peers, []nftables.SetElement{{Key: ip.To4()}}); err != nil {
+				return netErr("remove peer", ip.String(), err)
+			}
+			return netErr("remove peer", ip.String(), c.Flush())
+		}
+	}
+	return nil
+}
+
+func peersSetConn() (*nftables.Conn, *nftables.Set, error) {
+	c, err := nftables.New()
+	if err != nil {
+		return nil, nil, netErr("open nftables", "", err)
+	}
+	table := &nftables.Table{Name: firewallTable, Family: nftables.TableFamilyIPv4}
+	peers, err := c.GetSetByName(table, peersSet)
+	if err != nil {
+		return nil, nil, netErr("lookup peers set", "", err)
+	}
+	return c, peers, nil
+}
+
+// matchAddrInSet matches packets whose IPv4 address at offset of the
+// network header, 12 for the source or 16 for the destination, is in set
+func matchAddrInSet(offset uint32, set *nftables.Set) []expr.Any {
+	return []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 4},
+		&expr.Lookup{SourceRegister: 1, SetName: set.Name, SetID: set.ID},
+	}
+}
+
+// matchSourceSubnet matches packets whose IPv4 source is inside subnet
+func matchSourceSubnet(subnet *net.IPNet) []expr.Any {
+	return []expr.Any{
+		// ip saddr is 4 bytes at offset 12 of the network header
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: subnet.Mask, Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: subnet.IP.To4()},
+	}
+}
+
+// matchIfname matches the input or output interface name
+func matchIfname(key expr.MetaKey, name string) []expr.Any {
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname},
+	}
+}
+
+// matchCtState matches connections in any of the given conntrack states
+func matchCtState(states uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(states), Xor: make([]byte, 4)},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+	}
+}
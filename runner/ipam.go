@@ -0,0 +1,202 @@
+package runner
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrSubnetExhausted is returned when every guest address is leased
+var ErrSubnetExhausted = errors.New("no free guest addresses in subnet")
+
+// Lease is the network identity handed to a single VM
+type Lease struct {
+	VMID    string `json:"vm_id"`
+	IP      net.IP `json:"ip"`
+	MAC     string `json:"mac"`
+	TapName string `json:"tap"`
+}
+
+// IPAM leases unique guest IP/MAC/TAP triples out of a subnet. The first
+// host address is reserved for the bridge, which acts as the guests'
+// gateway. Leases are written to statePath on every change so they can be
+// reclaimed if the service dies without cleaning up.
+type IPAM struct {
+	mu        sync.Mutex
+	subnet    *net.IPNet
+	gateway   net.IP
+	statePath string
+	leases    map[uint32]*Lease // keyed by host offset within the subnet
+	stale     []*Lease          // left behind by a previous run
+}
+
+// NewIPAM creates an address manager for the given CIDR subnet. Leases left
+// behind in statePath are kept aside until Reclaim is called.
+func NewIPAM(cidr, statePath string) (*IPAM, error) {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid guest subnet %q: %w", cidr, err)
+	}
+	if subnet.IP.To4() == nil {
+		return nil, fmt.Errorf("guest subnet %q must be IPv4", cidr)
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 29 {
+		return nil, fmt.Errorf("guest subnet %q is too small", cidr)
+	}
+
+	m := &IPAM{
+		subnet:    subnet,
+		gateway:   hostAddr(subnet, 1),
+		statePath: statePath,
+		leases:    make(map[uint32]*Lease),
+	}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Gateway returns the bridge address guests route through
+func (m *IPAM) Gateway() net.IP {
+	return m.gateway
+}
+
+// Subnet returns the subnet guests are leased from
+func (m *IPAM) Subnet() *net.IPNet {
+	return m.subnet
+}
+
+// Acquire leases the lowest free guest address to vmID
+func (m *IPAM) Acquire(vmID string) (*Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Skip the network address, the gateway and the broadcast address
+	for off := uint32(2); off < m.size()-1; off++ {
+		if _, taken := m.leases[off]; taken {
+			continue
+		}
+		ip := hostAddr(m.subnet, off)
+		lease := &Lease{
+			VMID:    vmID,
+			IP:      ip,
+			MAC:     macForIP(ip),
+			TapName: fmt.Sprintf("fc-tap-%d", off),
+		}
+		m.leases[off] = lease
+		if err := m.save(); err != nil {
+			delete(m.leases, off)
+			return nil, err
+		}
+		return lease, nil
+	}
+	return nil, ErrSubnetExhausted
+}
+
+// Reclaim hands every lease left behind by a previous run to cleanup and
+// then forgets them. Only one service instance owns the state file, so any
+// lease found at startup belongs to a VM that no longer exists.
+func (m *IPAM) Reclaim(cleanup func(Lease)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, l := range m.stale {
+		cleanup(*l)
+	}
+	m.stale = nil
+	return m.save()
+}
+
+// Release returns a lease to the pool
+func (m *IPAM) Release(lease *Lease) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	off, ok := m.offset(lease.IP)
+	if !ok {
+		return fmt.Errorf("address %s is not in subnet %s", lease.IP, m.subnet)
+	}
+	if cur, ok := m.leases[off]; !ok || cur.VMID != lease.VMID {
+		return nil
+	}
+	delete(m.leases, off)
+	return m.save()
+}
+
+// Netmask returns the subnet mask in dotted form for kernel ip= arguments
+func (m *IPAM) Netmask() string {
+	return net.IP(m.subnet.Mask).String()
+}
+
+func (m *IPAM) size() uint32 {
+	ones, bits := m.subnet.Mask.Size()
+	return 1 << uint(bits-ones)
+}
+
+func (m *IPAM) offset(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !m.subnet.Contains(ip4) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(ip4) - binary.BigEndian.Uint32(m.subnet.IP.To4()), true
+}
+
+func (m *IPAM) load() error {
+	data, err := os.ReadFile(m.statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read lease state: %w", err)
+	}
+
+	var leases []*Lease
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return fmt.Errorf("failed to parse lease state: %w", err)
+	}
+	m.stale = leases
+	return nil
+}
+
+// save persists the lease table atomically
+func (m *IPAM) save() error {
+	leases := make([]*Lease, 0, len(m.leases))
+	for _, l := range m.leases {
+		leases = append(leases, l)
+	}
+	data, err := json.MarshalIndent(leases, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(m.statePath), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+	tmp := m.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lease state: %w", err)
+	}
+	if err := os.Rename(tmp, m.statePath); err != nil {
+		return fmt.Errorf("failed to write lease state: %w", err)
+	}
+	return nil
+}
+
+// hostAddr returns the address at offset off within subnet
+func hostAddr(subnet *net.IPNet, off uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(subnet.IP.To4())+off)
+	return ip
+}
+
+// macForIP derives a locally administered unicast MAC from the guest IP so
+// a lease always maps to the same MAC
+func macForIP(ip net.IP) string {
+	ip4 := ip.To4()
+	return fmt.Sprintf("06:00:%02x:%02x:%02x:%02x", ip4[0], ip4[1], ip4[2], ip4[3])
+}
@@ -0,0 +1,142 @@
+package runner
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestNewIPAM(t *testing.T) {
+	tests := []struct {
+		cidr string
+		ok   bool
+	}{
+		{"192.168.100.0/24", true},
+		{"10.0.0.0/29", true},
+		{"10.0.0.0/30", false},
+		{"fd00::/64", false},
+		{"not a subnet", false},
+	}
+	for _, tt := range tests {
+		_, err := NewIPAM(tt.cidr, filepath.Join(t.TempDir(), "leases.json"))
+		if (err == nil) != tt.ok {
+			t.Errorf("NewIPAM(%q) = %v, want ok %v", tt.cidr, err, tt.ok)
+		}
+	}
+}
+
+func TestIPAMAcquireRelease(t *testing.T) {
+	// A /29 has six hosts, one of them the gateway
+	m, err := NewIPAM("10.0.0.0/29", filepath.Join(t.TempDir(), "leases.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.Gateway().String(); got != "10.0.0.1" {
+		t.Errorf("gateway %s, want 10.0.0.1", got)
+	}
+
+	var leases []*Lease
+	for _, want := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"} {
+		l, err := m.Acquire("vm-" + want)
+		if err != nil {
+			t.Fatalf("acquiring %s: %v", want, err)
+		}
+		if l.IP.String() != want {
+			t.Errorf("leased %s, want %s", l.IP, want)
+		}
+		leases = append(leases, l)
+	}
+	if _, err := m.Acquire("one too many"); !errors.Is(err, ErrSubnetExhausted) {
+		t.Fatalf("got %v with every address leased, want ErrSubnetExhausted", err)
+	}
+
+	// Each lease has its own MAC and TAP
+	macs, taps := map[string]bool{}, map[string]bool{}
+	for _, l := range leases {
+		if macs[l.MAC] || taps[l.TapName] {
+			t.Errorf("lease %s shares its MAC or TAP", l.IP)
+		}
+		macs[l.MAC], taps[l.TapName] = true, true
+	}
+	if got := leases[0].MAC; got != "06:00:0a:00:00:02" {
+		t.Errorf("MAC %s, want 06:00:0a:00:00:02", got)
+	}
+
+	// A released address is the next one leased
+	if err := m.Release(leases[1]); err != nil {
+		t.Fatal(err)
+	}
+	l, err := m.Acquire("reuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.IP.String() != "10.0.0.3" {
+		t.Errorf("leased %s after a release, want 10.0.0.3", l.IP)
+	}
+
+	// Releasing a lease that was already handed on leaves the new one
+	if err := m.Release(leases[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Acquire("again"); !errors.Is(err, ErrSubnetExhausted) {
+		t.Errorf("stale release freed the address of another VM: %v", err)
+	}
+}
+
+func TestIPAMReclaim(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "state", "leases.json")
+	m, err := NewIPAM("10.0.0.0/24", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if _, err := m.Acquire(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, _ := m.Acquire("d")
+	m.Release(b)
+
+	// A new instance over the same state finds what the last one left
+	m2, err := NewIPAM("10.0.0.0/24", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reclaimed []string
+	if err := m2.Reclaim(func(l Lease) { reclaimed = append(reclaimed, l.VMID+"@"+l.IP.String()) }); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(reclaimed)
+	want := []string{"a@10.0.0.2", "b@10.0.0.3", "c@10.0.0.4"}
+	if len(reclaimed) != len(want) {
+		t.Fatalf("reclaimed %v, want %v", reclaimed, want)
+	}
+	for i := range want {
+		if reclaimed[i] != want[i] {
+			t.Fatalf("reclaimed %v, want %v", reclaimed, want)
+		}
+	}
+
+	// Reclaimed addresses are free again, and forgotten on disk
+	l, err := m2.Acquire("e")
+	if err != nil || l.IP.String() != "10.0.0.2" {
+		t.Errorf("got %v, %v after reclaiming, want 10.0.0.2", l, err)
+	}
+	m3, err := NewIPAM("10.0.0.0/24", state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m3.stale) != 1 || m3.stale[0].VMID != "e" {
+		t.Errorf("state holds %v after reclaiming, want only e", m3.stale)
+	}
+}
+
+func TestIPAMBadState(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "leases.json")
+	os.WriteFile(state, []byte("{not json"), 0644)
+	if _, err := NewIPAM("10.0.0.0/24", state); err == nil {
+		t.Error("corrupt lease state accepted")
+	}
+}
@@ -0,0 +1,173 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/sirupsen/logrus"
+)
+
+// JailerConfig has every VMM started by Firecracker's jailer: chrooted
+// into a directory of its own, running as UID and GID, in a network
+// namespace of its own and in its cgroup, limited to the VM's vCPUs and
+// memory.
+type JailerConfig struct {
+	// Binary is the jailer and ExecFile the firecracker it runs; both are
+	// looked up in PATH
+	Binary   string
+	ExecFile string
+	// ChrootBaseDir holds the chroots. Kernel images and snapshots on the
+	// same filesystem are linked into them rather than copied.
+	ChrootBaseDir string
+	UID           int
+	GID           int
+}
+
+// vmmOverheadMB is the memory a VMM may use on top of its guest's
+const vmmOverheadMB = 64
+
+// cpuPeriod is the cpu.max period, in microseconds
+const cpuPeriod = 100000
+
+// jailer is nil unless EnableJailer was called
+var jailer *JailerConfig
+
+// EnableJailer makes the firecracker runner start every VMM under the
+// jailer. The jailer creates each VMM's cgroup, so EnableCgroups must
+// have been called first. The chroots and network namespaces of VMs left
+// behind by a previous run that crashed are removed, so it must be called
+// before any VM is started.
+func EnableJailer(cfg JailerConfig) error {
+	if cfg.UID == 0 || cfg.GID == 0 {
+		return fmt.Errorf("jailer uid and gid must not be root")
+	}
+	if cgroupParent == "" {
+		return fmt.Errorf("jailer: cgroups are not enabled")
+	}
+	bin, err := exec.LookPath(cfg.Binary)
+	if err != nil {
+		return fmt.Errorf("jailer: %w", err)
+	}
+	cfg.Binary = bin
+	exe, err := exec.LookPath(cfg.ExecFile)
+	if err != nil {
+		return fmt.Errorf("jailer: %w", err)
+	}
+	// The jailer only takes an absolute exec file
+	if cfg.ExecFile, err = filepath.Abs(exe); err != nil {
+		return err
+	}
+	if cfg.ChrootBaseDir, err = filepath.Abs(cfg.ChrootBaseDir); err != nil {
+		return err
+	}
+
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	base := filepath.Join(cfg.ChrootBaseDir, filepath.Base(cfg.ExecFile))
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return fmt.Errorf("jailer: %w", err)
+	}
+	stale, err := os.ReadDir(base)
+	if err != nil {
+		return fmt.Errorf("jailer: %w", err)
+	}
+	for _, e := range stale {
+		logger.Infof("Removing stale jail of VM %s", e.Name())
+		os.RemoveAll(filepath.Join(base, e.Name()))
+		deleteNetNS(netNSName(e.Name()), logger)
+	}
+
+	jailer = &cfg
+	return nil
+}
+
+// jailDir is the directory the jailer builds VM vmID's chroot in
+func (j *JailerConfig) jailDir(vmID string) string {
+	return filepath.Join(j.ChrootBaseDir, filepath.Base(j.ExecFile), vmID)
+}
+
+// command returns the jailer command starting vm's VMM, limited to the
+// vCPUs and memory of cfg. The VMM's API socket is at the root of its
+// chroot.
+func (j *JailerConfig) command(ctx context.Context, vm *microVM, cfg VMConfig) *exec.Cmd {
+	args := []string{
+		"--id", vm.id,
+		"--uid", strconv.Itoa(j.UID),
+		"--gid", strconv.Itoa(j.GID),
+		"--exec-file", j.ExecFile,
+		"--chroot-base-dir", j.ChrootBaseDir,
+		"--cgroup-version", "2",
+		"--parent-cgroup", cgroupParent,
+		"--cgroup", fmt.Sprintf("memory.max=%d", (cfg.MemSizeMB+vmmOverheadMB)<<20),
+		"--cgroup", fmt.Sprintf("cpu.max=%d %d", cfg.CPUs*cpuPeriod, cpuPeriod),
+	}
+	if vm.netns != "" {
+		args = append(args, "--netns", netNSPath(vm.netns))
+	}
+	args = append(args, "--", "--api-sock", "/firecracker.sock")
+
+	cmd := exec.CommandContext(ctx, j.Binary, args...)
+	cmd.Stdout = vm.system
+	cmd.Stderr = vm.system
+	return cmd
+}
+
+// own hands a file in vm's directory to the jail's user, so the jailed
+// VMM can open it; for a VM that isn't jailed it does nothing
+func (vm *microVM) own(path string) error {
+	if vm.jailDir == "" {
+		return nil
+	}
+	if err := os.Chown(path, jailer.UID, jailer.GID); err != nil {
+		return fmt.Errorf("failed to hand %s to the jail: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// expose returns the path vm's VMM opens the file at hostPath by. A
+// jailed VMM only sees its chroot, so the file is linked into it, or
+// copied when it is on another filesystem. Linked files keep their owner:
+// kernel images are world readable, and snapshots restored by jailed VMs
+// were written by jailed VMs.
+func (vm *microVM) expose(hostPath string) (string, error) {
+	if vm.jailDir == "" {
+		return hostPath, nil
+	}
+	name := filepath.Base(hostPath)
+	dest := filepath.Join(vm.dir, name)
+	if err := os.Link(hostPath, dest); err == nil {
+		return name, nil
+	}
+	if err := cloneRootFS(hostPath, dest); err != nil {
+		return "", err
+	}
+	return name, vm.own(dest)
+}
+
+// jailedLogFiles replaces the SDK's handler creating the log and metrics
+// FIFOs, which would create them at the paths the jailed VMM opens them
+// by rather than in its chroot
+func jailedLogFiles(vm *microVM) firecracker.Opt {
+	return func(m *firecracker.Machine) {
+		m.Handlers.FcInit = m.Handlers.FcInit.Swap(firecracker.Handler{
+			Name: firecracker.CreateLogFilesHandlerName,
+			Fn: func(ctx context.Context, m *firecracker.Machine) error {
+				for _, name := range []string{m.Cfg.LogFifo, m.Cfg.MetricsFifo} {
+					path := filepath.Join(vm.dir, name)
+					if err := syscall.Mkfifo(path, 0600); err != nil {
+						return fmt.Errorf("failed to create %s: %w", name, err)
+					}
+					if err := vm.own(path); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/steveoni/microvm/agent"
+)
+
+// Local runs scripts as plain subprocesses on the host, so the whole
+// API -> queue -> runner -> log pipeline can be exercised on machines without
+// /dev/kvm, Firecracker or a built rootfs. Each script runs in fresh user,
+// mount, PID, UTS and IPC namespaces (plus a network namespace when
+// networking is disabled) under memory and CPU rlimits. This is far weaker
+// than a microVM and must not be used for untrusted code.
+type Local struct{}
+
+func (Local) Name() string {
+	return "local"
+}
+
+func (Local) Run(ctx context.Context, cfg VMConfig, out Output) (*Result, error) {
+	// Run from a private copy so the script can't modify the stored one
+	tmpDir, err := os.MkdirTemp("", "microvm-local-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	workDir := filepath.Join(tmpDir, "work")
+	outDir := filepath.Join(tmpDir, "out")
+	if err := copyTree(cfg.ScriptDir, workDir); err != nil {
+		return nil, fmt.Errorf("failed to copy script: %w", err)
+	}
+	if err := os.Mkdir(outDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %w", err)
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	build := func(isolate bool) *exec.Cmd {
+		return localCommand(runCtx, cfg, workDir, outDir, isolate, out)
+	}
+
+	fmt.Fprintf(out.System, "Running %s locally\n", cfg.Entrypoint)
+	startedAt := time.Now()
+	cmd := build(true)
+	if err := cmd.Start(); err != nil {
+		// Unprivileged user namespaces are disabled on some hosts, CI
+		// runners in particular; fall back to rlimits only
+		if !errors.Is(err, syscall.EPERM) && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOSPC) {
+			return nil, fmt.Errorf("failed to start script: %w", err)
+		}
+		fmt.Fprintf(out.System, "WARNING: namespaces unavailable (%v), running without them\n", err)
+		cmd = build(false)
+		if err := cmd.Start(); err != nil {
+			return nil, fmt.Errorf("failed to start script: %w", err)
+		}
+	}
+
+	waitErr := cmd.Wait()
+	result := &Result{Duration: time.Since(startedAt)}
+
+	switch {
+	case runCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil:
+		result.TimedOut = true
+		fmt.Fprintf(out.System, "Script timed out after %s\n", timeout)
+	case ctx.Err() != nil:
+		fmt.Fprintln(out.System, "Script stopped")
+	default:
+		var exitErr *exec.ExitError
+		if waitErr != nil && !errors.As(waitErr, &exitErr) {
+			return nil, fmt.Errorf("failed to run script: %w", waitErr)
+		}
+		code := exitStatus(cmd.ProcessState)
+		result.ExitCode = &code
+		result.Usage = &Usage{
+			UserCPU:   cmd.ProcessState.UserTime(),
+			SystemCPU: cmd.ProcessState.SystemTime(),
+		}
+		if ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+			result.Usage.MaxRSSKB = ru.Maxrss
+		}
+		fmt.Fprintf(out.System, "Script exited with code %d\n", code)
+	}
+
+	if out.Artifacts != nil {
+		skipped, err := agent.PackDir(out.Artifacts, outDir, cfg.MaxArtifactBytes)
+		if err != nil {
+			fmt.Fprintf(out.System, "Failed to collect artifacts: %v\n", err)
+		}
+		for _, name := range skipped {
+			fmt.Fprintf(out.System, "Artifact %s not collected, over the size limit\n", name)
+		}
+	}
+
+	return result, nil
+}
+
+// localCommand builds the command for one attempt at running the script.
+// rlimits are applied by a tiny shell wrapper so they are in place before
+// the script's first instruction.
+func localCommand(ctx context.Context, cfg VMConfig, workDir, outDir string, isolate bool, out Output) *exec.Cmd {
+	limits := "exec \"$@\""
+	if cfg.MemSizeMB > 0 {
+		limits = fmt.Sprintf("ulimit -v %d && %s", cfg.MemSizeMB*1024, limits)
+	}
+	if cfg.Timeout > 0 {
+		limits = fmt.Sprintf("ulimit -t %d && %s", int64(cfg.Timeout.Seconds())+1, limits)
+	}
+
+	args := append([]string{"-c", limits, "sh"}, scriptCommand(cfg.Interpreter, "./"+cfg.Entrypoint)...)
+	args = append(args, cfg.Args...)
+	cmd := exec.CommandContext(ctx, "/bin/sh", args...)
+	cmd.Dir = workDir
+	cmd.Env = []string{
+		"PATH=/usr/local/bin:/usr/bin:/bin",
+		"HOME=" + workDir,
+		"PYTHONUNBUFFERED=1",
+	}
+	for k, v := range scriptEnv(cfg.Env, outDir) {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdin = bytes.NewReader(cfg.Stdin)
+	cmd.Stdout = out.Stdout
+	cmd.Stderr = out.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if isolate {
+		flags := syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+		if !cfg.EnableNetwork {
+			flags |= syscall.CLONE_NEWNET
+		}
+		cmd.SysProcAttr.Cloneflags = uintptr(flags)
+		cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	}
+
+	// Kill the whole process group, not just the wrapper shell
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 2 * time.Second
+	return cmd
+}
+
+// copyTree copies the regular files under src into dst
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
+
+// exitStatus mirrors the shell convention of 128+N for a signal death
+func exitStatus(state *os.ProcessState) int {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return state.ExitCode()
+}
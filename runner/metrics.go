@@ -0,0 +1,206 @@
+package runner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+)
+
+// metricsFlushTimeout bounds asking a VMM to write out its metrics
+const metricsFlushTimeout = 2 * time.Second
+
+// maxMetricsLine bounds a line of the metrics FIFO; Firecracker writes a
+// few kilobytes at a time
+const maxMetricsLine = 1 << 20
+
+// vmmMetricsStats is published at /debug/vars with the counters of
+// VMMCounters summed over every VM that ran a job, named section.counter
+// as Firecracker names them, and vms counting those VMs
+var vmmMetricsStats = expvar.NewMap("vmm_metrics")
+
+// VMMMetrics summarises what a VM's Firecracker wrote to its metrics FIFO
+// over the VM's life. Fields are named as Firecracker names them.
+type VMMMetrics struct {
+	// Flushes is how many times the VMM wrote its metrics
+	Flushes int64 `json:"flushes"`
+	// APIServer holds how long the VMM process took to start up
+	APIServer struct {
+		ProcessStartupTimeUs    int64 `json:"process_startup_time_us"`
+		ProcessStartupTimeCPUUs int64 `json:"process_startup_time_cpu_us"`
+	} `json:"api_server"`
+	// Latencies holds how long restoring the VM from a snapshot took, 0
+	// for a VM that was booted
+	Latencies struct {
+		LoadSnapshot int64 `json:"load_snapshot"`
+	} `json:"latencies_us"`
+	VMMCounters
+}
+
+// VMMCounters are the metrics Firecracker reports as the count since it
+// last wrote them, so they are summed over every line
+type VMMCounters struct {
+	VCPU struct {
+		ExitIOIn      int64 `json:"exit_io_in"`
+		ExitIOOut     int64 `json:"exit_io_out"`
+		ExitMMIORead  int64 `json:"exit_mmio_read"`
+		ExitMMIOWrite int64 `json:"exit_mmio_write"`
+		Failures      int64 `json:"failures"`
+	} `json:"vcpu"`
+	// Block and Net are summed over the VM's drives and interfaces
+	Block struct {
+		ReadCount            int64 `json:"read_count"`
+		WriteCount           int64 `json:"write_count"`
+		ReadBytes            int64 `json:"read_bytes"`
+		WriteBytes           int64 `json:"write_bytes"`
+		FlushCount           int64 `json:"flush_count"`
+		InvalidReqs          int64 `json:"invalid_reqs"`
+		ExecuteFails         int64 `json:"execute_fails"`
+		EventFails           int64 `json:"event_fails"`
+		NoAvailBuffer        int64 `json:"no_avail_buffer"`
+		RateLimiterThrottled int64 `json:"rate_limiter_throttled_events"`
+		ActivateFails        int64 `json:"activate_fails"`
+		QueueEvents          int64 `json:"queue_event_count"`
+		IOEngineThrottled    int64 `json:"io_engine_throttled_events"`
+	} `json:"block"`
+	Net struct {
+		RxCount           int64 `json:"rx_count"`
+		TxCount           int64 `json:"tx_count"`
+		RxBytes           int64 `json:"rx_bytes_count"`
+		TxBytes           int64 `json:"tx_bytes_count"`
+		RxPackets         int64 `json:"rx_packets_count"`
+		TxPackets         int64 `json:"tx_packets_count"`
+		RxFails           int64 `json:"rx_fails"`
+		TxFails           int64 `json:"tx_fails"`
+		TapReadFails      int64 `json:"tap_read_fails"`
+		TapWriteFails     int64 `json:"tap_write_fails"`
+		TxMalformedFrames int64 `json:"tx_malformed_frames"`
+		NoRxAvailBuffer   int64 `json:"no_rx_avail_buffer"`
+		NoTxAvailBuffer   int64 `json:"no_tx_avail_buffer"`
+		EventFails        int64 `json:"event_fails"`
+		ActivateFails     int64 `json:"activate_fails"`
+	} `json:"net"`
+	Seccomp struct {
+		NumFaults int64 `json:"num_faults"`
+	} `json:"seccomp"`
+	Signals struct {
+		SIGBUS  int64 `json:"sigbus"`
+		SIGSEGV int64 `json:"sigsegv"`
+		SIGXFSZ int64 `json:"sigxfsz"`
+		SIGXCPU int64 `json:"sigxcpu"`
+		SIGPIPE int64 `json:"sigpipe"`
+		SIGHUP  int64 `json:"sighup"`
+		SIGILL  int64 `json:"sigill"`
+	} `json:"signals"`
+	VMM struct {
+		PanicCount int64 `json:"panic_count"`
+	} `json:"vmm"`
+}
+
+// each calls fn with the name and value of every counter in c
+func (c *VMMCounters) each(fn func(name string, v *int64)) {
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		section := sections.Field(i)
+		prefix := jsonName(sections.Type().Field(i))
+		for j := 0; j < section.NumField(); j++ {
+			fn(prefix+"."+jsonName(section.Type().Field(j)), section.Field(j).Addr().Interface().(*int64))
+		}
+	}
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
+
+// add folds a line of metrics into m
+func (m *VMMMetrics) add(line *VMMMetrics) {
+	m.Flushes++
+	// Startup and latencies are written as they are, and only once known
+	if line.APIServer.ProcessStartupTimeUs != 0 {
+		m.APIServer = line.APIServer
+	}
+	if line.Latencies.LoadSnapshot != 0 {
+		m.Latencies = line.Latencies
+	}
+	counts := make(map[string]int64)
+	line.each(func(name string, v *int64) { counts[name] = *v })
+	m.each(func(name string, v *int64) { *v += counts[name] })
+}
+
+// publish adds the counters of a VM that ran a job to the host's
+func (m *VMMMetrics) publish() {
+	vmmMetricsStats.Add("vms", 1)
+	m.each(func(name string, v *int64) { vmmMetricsStats.Add(name, *v) })
+}
+
+// readMetrics opens the VMM's metrics FIFO and decodes the lines written to
+// it into the VM's summary until the VMM closes it, or destroy does. Lines
+// that aren't metrics are skipped.
+func (vm *microVM) readMetrics(fifoPath string) {
+	// The VMM has the FIFO open by now, but opening without blocking means
+	// a VMM that already died can't leave us waiting for a writer
+	fifo, err := os.OpenFile(fifoPath, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		vm.logger.Errorf("Failed to open metrics FIFO: %v", err)
+		close(vm.metricsDone)
+		return
+	}
+	vm.metricsFIFO = fifo
+	go vm.decodeMetrics(fifo)
+}
+
+func (vm *microVM) decodeMetrics(fifo *os.File) {
+	defer close(vm.metricsDone)
+
+	scanner := bufio.NewScanner(fifo)
+	scanner.Buffer(make([]byte, 64*1024), maxMetricsLine)
+	for scanner.Scan() {
+		var line VMMMetrics
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			vm.logger.Debugf("Skipping metrics line: %v", err)
+			continue
+		}
+		vm.metricsMu.Lock()
+		vm.metrics.add(&line)
+		vm.metricsMu.Unlock()
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		vm.logger.Warnf("Failed to read metrics: %v", err)
+	}
+}
+
+// flushMetrics asks the VMM to write out its metrics now. A VMM writes them
+// itself when it exits on its own, but not when it is stopped.
+func (vm *microVM) flushMetrics() {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsFlushTimeout)
+	defer cancel()
+	client := firecracker.NewClient(vm.machine.Cfg.SocketPath, vm.logger, false)
+	_, err := client.CreateSyncAction(ctx, &models.InstanceActionInfo{
+		ActionType: firecracker.String(models.InstanceActionInfoActionTypeFlushMetrics),
+	})
+	if err != nil {
+		vm.logger.Warnf("Failed to flush VMM metrics: %v", err)
+	}
+}
+
+// vmmMetrics returns the VM's summary, nil if the VMM never wrote one
+func (vm *microVM) vmmMetrics() *VMMMetrics {
+	vm.metricsMu.Lock()
+	defer vm.metricsMu.Unlock()
+	if vm.metrics.Flushes == 0 {
+		return nil
+	}
+	m := vm.metrics
+	return &m
+}
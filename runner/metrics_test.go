@@ -0,0 +1,71 @@
+package runner
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestVMMMetricsAdd(t *testing.T) {
+	lines := []string{
+		`{"api_server":{"process_startup_time_us":1500,"process_startup_time_cpu_us":900},` +
+			`"latencies_us":{"load_snapshot":0},"block":{"read_bytes":4096,"read_count":1},` +
+			`"net":{"rx_bytes_count":100},"vcpu":{"exit_io_out":7},"uart":{"read_count":3}}`,
+		`{"latencies_us":{"load_snapshot":2300},"block":{"read_bytes":1024,"write_bytes":512,"read_count":2},` +
+			`"net":{"rx_bytes_count":50,"tx_bytes_count":20},"signals":{"sigbus":1}}`,
+		`{"block":{"flush_count":1}}`,
+	}
+
+	var m VMMMetrics
+	for _, l := range lines {
+		var line VMMMetrics
+		if err := json.Unmarshal([]byte(l), &line); err != nil {
+			t.Fatal(err)
+		}
+		m.add(&line)
+	}
+
+	tests := []struct {
+		name      string
+		got, want int64
+	}{
+		{"flushes", m.Flushes, 3},
+		// Written once and kept, never summed
+		{"startup", m.APIServer.ProcessStartupTimeUs, 1500},
+		{"startup cpu", m.APIServer.ProcessStartupTimeCPUUs, 900},
+		{"load snapshot", m.Latencies.LoadSnapshot, 2300},
+		// Counted since the last line, so summed
+		{"block read bytes", m.Block.ReadBytes, 5120},
+		{"block read count", m.Block.ReadCount, 3},
+		{"block write bytes", m.Block.WriteBytes, 512},
+		{"block flush count", m.Block.FlushCount, 1},
+		{"net rx bytes", m.Net.RxBytes, 150},
+		{"net tx bytes", m.Net.TxBytes, 20},
+		{"vcpu io out", m.VCPU.ExitIOOut, 7},
+		{"sigbus", m.Signals.SIGBUS, 1},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestVMMCountersEach(t *testing.T) {
+	var c VMMCounters
+	names := map[string]bool{}
+	c.each(func(name string, v *int64) {
+		if names[name] {
+			t.Errorf("counter %s named twice", name)
+		}
+		names[name] = true
+		*v = 1
+	})
+	for _, name := range []string{"vcpu.exit_io_in", "block.read_bytes", "net.tx_bytes_count", "seccomp.num_faults", "vmm.panic_count"} {
+		if !names[name] {
+			t.Errorf("counter %s missing", name)
+		}
+	}
+	if c.Net.TxBytes != 1 || c.VMM.PanicCount != 1 {
+		t.Error("counters not set through each")
+	}
+}
@@ -0,0 +1,226 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// bridgeName is the host bridge every guest TAP is attached to
+const bridgeName = "fcbr0"
+
+// ErrNoDefaultRoute is returned when the host has no IPv4 default route to
+// masquerade guest traffic through
+var ErrNoDefaultRoute = errors.New("no default route found")
+
+// NetworkError reports a failed host networking operation. The service
+// needs CAP_NET_ADMIN for these; a missing capability surfaces as an Err
+// wrapping unix.EPERM.
+type NetworkError struct {
+	Op   string
+	Link string
+	Err  error
+}
+
+func (e *NetworkError) Error() string {
+	if e.Link == "" {
+		return fmt.Sprintf("network: %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("network: %s %s: %v", e.Op, e.Link, e.Err)
+}
+
+func (e *NetworkError) Unwrap() error {
+	return e.Err
+}
+
+func netErr(op, link string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &NetworkError{Op: op, Link: link, Err: err}
+}
+
+// ensureBridge creates the guest bridge if needed, gives it addr and
+// brings it up
+func ensureBridge(name string, addr *net.IPNet) (netlink.Link, error) {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return nil, netErr("lookup bridge", name, err)
+		}
+		bridge := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: name}}
+		if err := netlink.LinkAdd(bridge); err != nil {
+			return nil, netErr("create bridge", name, err)
+		}
+		if br, err = netlink.LinkByName(name); err != nil {
+			return nil, netErr("lookup bridge", name, err)
+		}
+	}
+
+	// Replace keeps this idempotent across restarts
+	if err := netlink.AddrReplace(br, &netlink.Addr{IPNet: addr}); err != nil {
+		return nil, netErr("set bridge address", name, err)
+	}
+	if err := netlink.LinkSetUp(br); err != nil {
+		return nil, netErr("set bridge up", name, err)
+	}
+	return br, nil
+}
+
+// createTap creates a persistent TAP device for firecracker to open and
+// attaches it to the bridge
+func createTap(name string, bridge netlink.Link) (netlink.Link, error) {
+	tap := &netlink.Tuntap{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		Mode:      netlink.TUNTAP_MODE_TAP,
+		Flags:     netlink.TUNTAP_NO_PI | netlink.TUNTAP_VNET_HDR,
+	}
+	if err := netlink.LinkAdd(tap); err != nil {
+		return nil, netErr("create tap", name, err)
+	}
+	// LinkAdd leaves the creating file descriptors open
+	for _, f := range tap.Fds {
+		f.Close()
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, netErr("lookup tap", name, err)
+	}
+	if err := netlink.LinkSetMaster(link, bridge); err != nil {
+		return nil, netErr("attach tap to bridge", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, netErr("set tap up", name, err)
+	}
+	return link, nil
+}
+
+// createVeth creates a veth pair, attaching the end called name to the
+// bridge and bringing it up. The peer is left down for the caller to move.
+func createVeth(name, peer string, bridge netlink.Link) (netlink.Link, error) {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: name, MasterIndex: bridge.Attrs().Index},
+		PeerName:  peer,
+	}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, netErr("create veth", name, err)
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return nil, netErr("lookup veth", name, err)
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, netErr("set veth up", name, err)
+	}
+	return link, nil
+}
+
+// deleteTap removes a TAP device; a device that is already gone is not an
+// error
+func deleteTap(name string) error {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return netErr("lookup tap", name, err)
+	}
+	return netErr("delete tap", name, netlink.LinkDel(link))
+}
+
+// setPortIsolated marks a bridge port isolated, equivalent to
+// `bridge link set dev $link isolated on`. Isolated ports can only forward
+// to non-isolated ports, which keeps guests from reaching each other. The
+// netlink package has no helper for this attribute, so the request is
+// built by hand.
+func setPortIsolated(link netlink.Link, isolated bool) error {
+	req := nl.NewNetlinkRequest(unix.RTM_SETLINK, unix.NLM_F_ACK)
+
+	msg := nl.NewIfInfomsg(unix.AF_BRIDGE)
+	msg.Index = int32(link.Attrs().Index)
+	req.AddData(msg)
+
+	var val byte
+	if isolated {
+		val = 1
+	}
+	protinfo := nl.NewRtAttr(unix.IFLA_PROTINFO|unix.NLA_F_NESTED, nil)
+	protinfo.AddRtAttr(unix.IFLA_BRPORT_ISOLATED, []byte{val})
+	req.AddData(protinfo)
+
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return netErr("set port isolation", link.Attrs().Name, err)
+}
+
+// attachGuestPort isolates a guest's port on the bridge, so whatever the
+// job asked for the guest can't reach another guest directly. With
+// allowPeers the guest's address joins the firewall's peers, which lets
+// it reach other peers routed through the gateway instead.
+func attachGuestPort(port netlink.Link, ip net.IP, allowPeers bool) error {
+	if err := setPortIsolated(port, true); err != nil {
+		return err
+	}
+	if allowPeers {
+		return addPeer(ip)
+	}
+	return nil
+}
+
+// enableProxyARP makes the host answer ARP on the bridge for addresses
+// behind the bridge itself, equivalent to
+// `sysctl net.ipv4.conf.$bridge.proxy_arp_pvlan=1`. Guests on isolated
+// ports can't resolve each other, so this is what sends traffic between
+// them to the gateway, where the firewall decides whether it goes on.
+func enableProxyARP(bridge string) error {
+	err := os.WriteFile("/proc/sys/net/ipv4/conf/"+bridge+"/proxy_arp_pvlan", []byte("1\n"), 0644)
+	return netErr("enable proxy arp", bridge, err)
+}
+
+// enableIPForward turns on IPv4 forwarding so guest traffic can leave the
+// bridge
+func enableIPForward() error {
+	err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644)
+	return netErr("enable ip forwarding", "", err)
+}
+
+// defaultInterface returns the name of the link carrying the IPv4 default
+// route
+func defaultInterface() (string, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return "", netErr("list routes", "", err)
+	}
+	for _, r := range routes {
+		if r.Dst != nil && r.Dst.String() != "0.0.0.0/0" {
+			continue
+		}
+		link, err := netlink.LinkByIndex(r.LinkIndex)
+		if err != nil {
+			return "", netErr("lookup default route link", "", err)
+		}
+		return link.Attrs().Name, nil
+	}
+	return "", netErr("find default interface", "", ErrNoDefaultRoute)
+}
+
+// linkBytes returns the bytes received and sent by the named link
+func linkBytes(name string) (rx, tx uint64, err error) {
+	link, err := netlink.LinkByName(name)
+	if err != nil {
+		return 0, 0, netErr("lookup", name, err)
+	}
+	stats := link.Attrs().Statistics
+	if stats == nil {
+		return 0, 0, netErr("read statistics", name, errors.New("no statistics"))
+	}
+	return stats.RxBytes, stats.TxBytes, nil
+}
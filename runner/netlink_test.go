@@ -0,0 +1,135 @@
+package runner
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// inTestNetNS runs fn in a network namespace of its own, which goes away
+// afterwards, skipping the test where one can't be created
+func inTestNetNS(t *testing.T, fn func() error) {
+	t.Helper()
+	created := false
+	err := withThread(func() error {
+		ns, err := netns.New()
+		if err != nil {
+			return err
+		}
+		defer ns.Close()
+		created = true
+		return fn()
+	})
+	if !created {
+		t.Skipf("no network namespace: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// portIsolated reads back the isolated flag of a bridge port
+func portIsolated(link netlink.Link) (bool, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_DUMP)
+	req.AddData(nl.NewIfInfomsg(unix.AF_BRIDGE))
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range msgs {
+		msg := nl.DeserializeIfInfomsg(m)
+		if int(msg.Index) != link.Attrs().Index {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+		if err != nil {
+			return false, err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type != unix.IFLA_PROTINFO|unix.NLA_F_NESTED {
+				continue
+			}
+			info, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return false, err
+			}
+			for _, a := range info {
+				if a.Attr.Type == unix.IFLA_BRPORT_ISOLATED {
+					return a.Value[0] == 1, nil
+				}
+			}
+		}
+	}
+	return false, fmt.Errorf("no port info for %s", link.Attrs().Name)
+}
+
+func TestAttachGuestPort(t *testing.T) {
+	inTestNetNS(t, func() error {
+		_, subnet, _ := net.ParseCIDR("10.0.0.0/24")
+		bridge, err := ensureBridge(bridgeName, &net.IPNet{IP: net.IPv4(10, 0, 0, 1), Mask: subnet.Mask})
+		if err != nil {
+			return err
+		}
+		if err := enableProxyARP(bridgeName); err != nil {
+			return err
+		}
+		if err := applyFirewall(subnet, bridgeName, "lo"); err != nil {
+			return err
+		}
+
+		tests := []struct {
+			name       string
+			ip         net.IP
+			allowPeers bool
+		}{
+			{"tap0", net.IPv4(10, 0, 0, 2), false},
+			{"tap1", net.IPv4(10, 0, 0, 3), true},
+		}
+		for _, tt := range tests {
+			tap, err := createTap(tt.name, bridge)
+			if err != nil {
+				return err
+			}
+			if err := attachGuestPort(tap, tt.ip, tt.allowPeers); err != nil {
+				return err
+			}
+			// Peers are isolated on the bridge too, they only meet through
+			// the gateway
+			isolated, err := portIsolated(tap)
+			if err != nil {
+				return err
+			}
+			if !isolated {
+				t.Errorf("port of a guest with peers %v isn't isolated", tt.allowPeers)
+			}
+
+			c, peers, err := peersSetConn()
+			if err != nil {
+				return err
+			}
+			elems, err := c.GetSetElements(peers)
+			if err != nil {
+				return err
+			}
+			if got := hasPeer(elems, tt.ip); got != tt.allowPeers {
+				t.Errorf("%s in peers: %v, want %v", tt.ip, got, tt.allowPeers)
+			}
+		}
+		return nil
+	})
+}
+
+func hasPeer(elems []nftables.SetElement, ip net.IP) bool {
+	for _, e := range elems {
+		if net.IP(e.Key).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// nsTapName is the TAP device of every VM with a network namespace of its
+// own: those snapshotted or restored from a snapshot, and jailed ones.
+// Firecracker reopens a restored VM's TAP by the name recorded in the
+// snapshot, so each such VM's namespace holds a TAP of that name. A bridge
+// in the namespace joins the TAP to one end of a veth pair; the other end,
+// named after the lease's TAP, is the VM's port on the host bridge.
+const nsTapName = "tap0"
+
+// nsBridgeName is the bridge inside a VM's network namespace
+const nsBridgeName = "br0"
+
+// netNSDir is where named network namespaces are mounted, as `ip netns`
+// does
+const netNSDir = "/var/run/netns"
+
+// netNSName is the network namespace of VM vmID
+func netNSName(vmID string) string {
+	return "fcvm-" + vmID
+}
+
+func netNSPath(name string) string {
+	return filepath.Join(netNSDir, name)
+}
+
+// leaseNetNS acquires a guest address for vmID and wires up a network
+// namespace for its VM, returning the lease and the namespace's name
+func leaseNetNS(vmID string, allowPeers bool, logger *logrus.Entry) (*Lease, string, error) {
+	if ipam == nil {
+		return nil, "", fmt.Errorf("networking not initialized")
+	}
+
+	lease, err := ipam.Acquire(vmID)
+	if err != nil {
+		return nil, "", err
+	}
+	name := netNSName(vmID)
+	if err := setupNetNS(name, lease, allowPeers, logger); err != nil {
+		releaseNetNS(lease, name, logger)
+		return nil, "", err
+	}
+	return lease, name, nil
+}
+
+// releaseNetNS tears down what leaseNetNS set up and frees the address
+func releaseNetNS(lease *Lease, name string, logger *logrus.Entry) {
+	releaseNetwork(lease, logger)
+	deleteNetNS(name, logger)
+}
+
+// setupNetNS creates the named network namespace and connects it to the
+// host bridge. The host end of the veth is an isolated bridge port, as a
+// TAP would be, with allowPeers joining the guest to the firewall's peers.
+func setupNetNS(name string, lease *Lease, allowPeers bool, logger *logrus.Entry) error {
+	bridge, err := netlink.LinkByName(bridgeName)
+	if err != nil {
+		return netErr("lookup bridge", bridgeName, err)
+	}
+
+	ns, err := createNetNS(name)
+	if err != nil {
+		return netErr("create netns", name, err)
+	}
+	defer ns.Close()
+
+	// The host end takes the TAP's name so crash recovery finds it
+	peerName := strings.Replace(lease.TapName, "tap", "veth", 1)
+	host, err := createVeth(lease.TapName, peerName, bridge)
+	if err != nil {
+		return err
+	}
+	if err := attachGuestPort(host, lease.IP, allowPeers); err != nil {
+		return err
+	}
+	peer, err := netlink.LinkByName(peerName)
+	if err != nil {
+		return netErr("lookup veth", peerName, err)
+	}
+	if err := netlink.LinkSetNsFd(peer, int(ns)); err != nil {
+		return netErr("move veth to netns", peerName, err)
+	}
+
+	err = inNetNS(ns, func() error {
+		br := &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: nsBridgeName}}
+		if err := netlink.LinkAdd(br); err != nil {
+			return netErr("create bridge", nsBridgeName, err)
+		}
+		if err := netlink.LinkSetUp(br); err != nil {
+			return netErr("set bridge up", nsBridgeName, err)
+		}
+		peer, err := netlink.LinkByName(peerName)
+		if err != nil {
+			return netErr("lookup veth", peerName, err)
+		}
+		if err := netlink.LinkSetMaster(peer, br); err != nil {
+			return netErr("attach veth to bridge", peerName, err)
+		}
+		if err := netlink.LinkSetUp(peer); err != nil {
+			return netErr("set veth up", peerName, err)
+		}
+		_, err = createTap(nsTapName, br)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("Network namespace %s attached to bridge %s through %s (peers: %t)", name, bridgeName, lease.TapName, allowPeers)
+	return nil
+}
+
+// deleteNetNS removes a network namespace; the devices in it go once the
+// VMM that had them open has exited. A namespace that is already gone is
+// not an error.
+func deleteNetNS(name string, logger *logrus.Entry) {
+	if _, err := os.Stat(netNSPath(name)); os.IsNotExist(err) {
+		return
+	}
+	if err := netns.DeleteNamed(name); err != nil {
+		logger.Warnf("Failed to delete network namespace %s: %v", name, err)
+	} else {
+		logger.Infof("Deleted network namespace %s", name)
+	}
+}
+
+// createNetNS creates a network namespace mounted under netNSDir and
+// returns a handle to it
+func createNetNS(name string) (netns.NsHandle, error) {
+	ns := netns.None()
+	err := withThread(func() error {
+		// NewNamed moves the calling thread into the new namespace
+		var err error
+		ns, err = netns.NewNamed(name)
+		return err
+	})
+	return ns, err
+}
+
+// inNetNS runs fn in the network namespace ns
+func inNetNS(ns netns.NsHandle, fn func() error) error {
+	return withThread(func() error {
+		if err := netns.Set(ns); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// withThread runs fn on an OS thread of its own, which fn may move to
+// another network namespace; the thread is moved back afterwards. A
+// thread that can't be moved back is never reused, since its goroutine
+// exits while still locked to it.
+func withThread(fn func() error) error {
+	errc := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		origin, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- err
+			return
+		}
+		defer origin.Close()
+
+		err = fn()
+		if serr := netns.Set(origin); serr != nil {
+			errc <- errors.Join(err, serr)
+			return
+		}
+		runtime.UnlockOSThread()
+		errc <- err
+	}()
+	return <-errc
+}
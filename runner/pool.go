@@ -0,0 +1,302 @@
+package runner
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PoolConfig describes a warm pool: how many VMs it keeps booted and the
+// shape they are booted with. A job is only served from a pool whose shape
+// it asks for exactly, with no kernel arguments of its own.
+type PoolConfig struct {
+	Name            string
+	Size            int
+	KernelImagePath string
+	RootFSPath      string
+	MemSizeMB       int64
+	CPUs            int64
+	EnableNetwork   bool
+	// Warmup is run in the guest the pool's VMs are restored from, when
+	// snapshots are enabled
+	Warmup []string
+}
+
+const (
+	// poolBootTimeout bounds how long a pooled guest may take to answer
+	// its first ping
+	poolBootTimeout = time.Minute
+	// poolPingTimeout bounds a health check of a parked guest
+	poolPingTimeout = 5 * time.Second
+	// poolRetryDelay spaces out boots after one fails, so a broken image
+	// doesn't spin
+	poolRetryDelay = 10 * time.Second
+)
+
+// poolStats is published at /debug/vars with a map per pool: hits and
+// misses of jobs that fit it, boots, boot and health check failures, and
+// the VMs ready now. unpooled counts jobs no pool fits.
+var poolStats = expvar.NewMap("warm_pools")
+
+// Pool keeps VMs booted and parked, each waiting on its guest agent for a
+// job. A VM is claimed by a single job and destroyed after it; the pool
+// boots a replacement in the background.
+type Pool struct {
+	cfg   PoolConfig
+	shape VMConfig
+	// wake tells the pool a VM has left it
+	wake chan struct{}
+	mu   sync.Mutex
+	// idle holds the VMs parked, oldest first. They stay there while they
+	// are checked on, so a job can claim one at any time.
+	idle []*microVM
+	// live counts the VMs parked or booting
+	live  int
+	stats *expvar.Map
+}
+
+var (
+	pools      []*Pool
+	stopPools  context.CancelFunc
+	poolsGroup sync.WaitGroup
+)
+
+// StartPools starts filling the pools in the background and checks on the
+// VMs parked in them every healthInterval. The pools are only used by the
+// firecracker runner, after InitNetwork.
+func StartPools(cfgs []PoolConfig, healthInterval time.Duration) error {
+	seen := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if cfg.Name == "" || seen[cfg.Name] {
+			return fmt.Errorf("warm pool names must be set and unique, got %q", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		if cfg.Size < 1 {
+			return fmt.Errorf("warm pool %s: size must be at least 1", cfg.Name)
+		}
+	}
+	if healthInterval <= 0 {
+		return fmt.Errorf("warm pool health interval must be positive")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopPools = cancel
+	for _, cfg := range cfgs {
+		p := &Pool{
+			cfg: cfg,
+			shape: VMConfig{
+				KernelImagePath: cfg.KernelImagePath,
+				RootFSPath:      cfg.RootFSPath,
+				MemSizeMB:       cfg.MemSizeMB,
+				CPUs:            cfg.CPUs,
+				EnableNetwork:   cfg.EnableNetwork,
+				Warmup:          cfg.Warmup,
+			},
+			wake:  make(chan struct{}, 1),
+			stats: new(expvar.Map).Init(),
+		}
+		p.stats.Set("ready", expvar.Func(func() any {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			return len(p.idle)
+		}))
+		poolStats.Set(cfg.Name, p.stats)
+		pools = append(pools, p)
+
+		poolsGroup.Add(1)
+		go func() {
+			defer poolsGroup.Done()
+			p.maintain(ctx, healthInterval)
+		}()
+	}
+	return nil
+}
+
+// StopPools stops refilling the pools and destroys the VMs parked in them
+func StopPools() {
+	if stopPools == nil {
+		return
+	}
+	stopPools()
+	poolsGroup.Wait()
+	for _, p := range pools {
+		p.mu.Lock()
+		for _, vm := range p.idle {
+			vm.destroy()
+		}
+		p.idle = nil
+		p.mu.Unlock()
+	}
+}
+
+// claimWarm takes a parked VM fitting cfg from any pool it fits, returning
+// it and the pool's name, or nil if there is none. Every pool cfg fits
+// counts a miss when none of them has a VM ready.
+func claimWarm(cfg VMConfig) (*microVM, string) {
+	if len(pools) == 0 {
+		return nil, ""
+	}
+	var fit []*Pool
+	for _, p := range pools {
+		if !p.fits(cfg) {
+			continue
+		}
+		if vm := p.claim(); vm != nil {
+			p.stats.Add("hits", 1)
+			p.left()
+			return vm, p.cfg.Name
+		}
+		fit = append(fit, p)
+	}
+	if len(fit) == 0 {
+		poolStats.Add("unpooled", 1)
+	}
+	for _, p := range fit {
+		p.stats.Add("misses", 1)
+	}
+	return nil, ""
+}
+
+// claim takes the oldest VM parked in the pool, nil if there is none
+func (p *Pool) claim() *microVM {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle) == 0 {
+		return nil
+	}
+	vm := p.idle[0]
+	p.idle = p.idle[1:]
+	return vm
+}
+
+// park adds a VM ready for a job to the pool
+func (p *Pool) park(vm *microVM) {
+	p.mu.Lock()
+	p.idle = append(p.idle, vm)
+	p.mu.Unlock()
+}
+
+// unpark takes vm out of the pool, reporting false if a job has claimed it
+func (p *Pool) unpark(vm *microVM) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	i := slices.Index(p.idle, vm)
+	if i < 0 {
+		return false
+	}
+	p.idle = slices.Delete(p.idle, i, i+1)
+	return true
+}
+
+// fits reports whether a VM from the pool is what cfg would boot
+func (p *Pool) fits(cfg VMConfig) bool {
+	return filepath.Clean(cfg.KernelImagePath) == filepath.Clean(p.shape.KernelImagePath) &&
+		filepath.Clean(cfg.RootFSPath) == filepath.Clean(p.shape.RootFSPath) &&
+		cfg.MemSizeMB == p.shape.MemSizeMB &&
+		cfg.CPUs == p.shape.CPUs &&
+		cfg.EnableNetwork == p.shape.EnableNetwork &&
+		slices.Equal(cfg.Warmup, p.shape.Warmup) &&
+		!cfg.AllowGuestTraffic &&
+		cfg.KernelArgs == ""
+}
+
+// left records that a VM is no longer parked in or booting for the pool
+func (p *Pool) left() {
+	p.mu.Lock()
+	p.live--
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// maintain keeps the pool full and healthy until ctx is done
+func (p *Pool) maintain(ctx context.Context, healthInterval time.Duration) {
+	logger := logrus.WithField("pool", p.cfg.Name)
+	health := time.NewTicker(healthInterval)
+	defer health.Stop()
+
+	for {
+		p.mu.Lock()
+		short := p.live < p.cfg.Size
+		if short {
+			p.live++
+		}
+		p.mu.Unlock()
+
+		if short {
+			vm, err := p.boot(ctx)
+			if err != nil {
+				p.left()
+				if ctx.Err() != nil {
+					return
+				}
+				p.stats.Add("boot_failures", 1)
+				logger.Warnf("Failed to boot warm VM: %v", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(poolRetryDelay):
+				}
+				continue
+			}
+			p.stats.Add("boots", 1)
+			p.park(vm)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-health.C:
+			p.check(ctx, logger)
+		}
+	}
+}
+
+// boot starts a VM for the pool and waits for its agent to answer
+func (p *Pool) boot(ctx context.Context) (*microVM, error) {
+	vm, err := startVM(ctx, p.shape, "", newRelay(nil), newRelay(nil))
+	if err != nil {
+		return nil, err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, poolBootTimeout)
+	defer cancel()
+	if err := pingAgent(pingCtx, vm.vsockPath, vm.logger); err != nil {
+		vm.destroy()
+		return nil, err
+	}
+	vm.logger.Infof("VM parked in warm pool %s", p.cfg.Name)
+	return vm, nil
+}
+
+// check pings every VM parked in the pool, replacing those that don't
+// answer. The VMs stay parked while they are pinged.
+func (p *Pool) check(ctx context.Context, logger *logrus.Entry) {
+	p.mu.Lock()
+	parked := slices.Clone(p.idle)
+	p.mu.Unlock()
+
+	for _, vm := range parked {
+		pingCtx, cancel := context.WithTimeout(ctx, poolPingTimeout)
+		err := pingAgent(pingCtx, vm.vsockPath, vm.logger)
+		cancel()
+		// A VM claimed while it was pinged has stopped answering pings
+		// because it is running a job
+		if err == nil || !p.unpark(vm) {
+			continue
+		}
+		p.stats.Add("health_failures", 1)
+		logger.Warnf("Warm VM %s failed its health check, replacing it: %v", vm.id, err)
+		vm.destroy()
+		p.left()
+	}
+}
@@ -0,0 +1,37 @@
+package runner
+
+import "testing"
+
+func TestPoolFits(t *testing.T) {
+	p := &Pool{shape: VMConfig{
+		KernelImagePath: "vm/images/vmlinux",
+		RootFSPath:      "vm/images/python.ext4",
+		MemSizeMB:       256,
+		CPUs:            1,
+		Warmup:          []string{"python3", "-c", "import json"},
+	}}
+
+	tests := []struct {
+		name string
+		edit func(*VMConfig)
+		want bool
+	}{
+		{"same shape", func(*VMConfig) {}, true},
+		{"uncleaned path", func(c *VMConfig) { c.RootFSPath = "vm/images/../images/python.ext4" }, true},
+		{"memory", func(c *VMConfig) { c.MemSizeMB = 512 }, false},
+		{"rootfs", func(c *VMConfig) { c.RootFSPath = "vm/images/rootfs.ext4" }, false},
+		{"network", func(c *VMConfig) { c.EnableNetwork = true }, false},
+		{"other warmup", func(c *VMConfig) { c.Warmup = []string{"python3", "-c", "import os"} }, false},
+		{"no warmup", func(c *VMConfig) { c.Warmup = nil }, false},
+		{"guest traffic", func(c *VMConfig) { c.AllowGuestTraffic = true }, false},
+		{"kernel args", func(c *VMConfig) { c.KernelArgs = "quiet" }, false},
+	}
+	for _, tt := range tests {
+		cfg := p.shape
+		cfg.Warmup = append([]string(nil), p.shape.Warmup...)
+		tt.edit(&cfg)
+		if got := p.fits(cfg); got != tt.want {
+			t.Errorf("%s: fits %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxRelayBuffer bounds what a relay holds before it has somewhere to
+// write, which is the boot log of a VM parked in a warm pool
+const maxRelayBuffer = 256 << 10
+
+// relay passes writes on to a destination that may only be known later.
+// Until then it buffers them, dropping what doesn't fit.
+type relay struct {
+	mu      sync.Mutex
+	w       io.Writer
+	buf     bytes.Buffer
+	dropped int
+}
+
+// newRelay returns a relay writing to w, or buffering if w is nil
+func newRelay(w io.Writer) *relay {
+	return &relay{w: w}
+}
+
+func (r *relay) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.w != nil {
+		return r.w.Write(p)
+	}
+	if r.buf.Len()+len(p) > maxRelayBuffer {
+		r.dropped += len(p)
+		return len(p), nil
+	}
+	return r.buf.Write(p)
+}
+
+// attach writes what was buffered to w and sends everything after to it
+func (r *relay) attach(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w.Write(r.buf.Bytes())
+	if r.dropped > 0 {
+		fmt.Fprintf(w, "\n[%d bytes dropped before the VM was claimed]\n", r.dropped)
+	}
+	r.buf = bytes.Buffer{}
+	r.w = w
+}
@@ -0,0 +1,76 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneBlockSize is the granularity used to detect holes when falling back
+// to a sparse copy
+const cloneBlockSize = 64 * 1024
+
+// cloneRootFS gives a VM its own writable copy of the base root filesystem.
+// On filesystems that support reflinks (btrfs, xfs) the copy shares blocks
+// with the base until the guest writes to them; elsewhere it falls back to a
+// sparse copy that skips zeroed blocks. The base image is only ever opened
+// read-only.
+func cloneRootFS(basePath, destPath string) error {
+	src, err := os.Open(basePath)
+	if err != nil {
+		return fmt.Errorf("failed to open base rootfs: %w", err)
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat base rootfs: %w", err)
+	}
+
+	dst, err := os.OpenFile(destPath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create rootfs copy: %w", err)
+	}
+
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err != nil {
+		err = sparseCopy(dst, src, info.Size())
+		if err != nil {
+			dst.Close()
+			os.Remove(destPath)
+			return fmt.Errorf("failed to copy rootfs: %w", err)
+		}
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(destPath)
+		return fmt.Errorf("failed to close rootfs copy: %w", err)
+	}
+	return nil
+}
+
+// sparseCopy copies src to dst, seeking over all-zero blocks so they stay
+// holes in the destination
+func sparseCopy(dst, src *os.File, size int64) error {
+	zero := make([]byte, cloneBlockSize)
+	buf := make([]byte, cloneBlockSize)
+
+	var off int64
+	for off < size {
+		n, err := io.ReadFull(src, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := dst.WriteAt(buf[:n], off); err != nil {
+				return err
+			}
+		}
+		off += int64(n)
+	}
+
+	// Extend over any trailing hole
+	return dst.Truncate(size)
+}
@@ -0,0 +1,101 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Runner executes a script in a sandbox. Implementations stream everything
+// the run produces to out as it happens and block until the script exits,
+// cfg.Timeout elapses or ctx is cancelled.
+type Runner interface {
+	Name() string
+	Run(ctx context.Context, cfg VMConfig, out Output) (*Result, error)
+}
+
+// Output receives a run's streams. Only Stdout and Stderr carry what the
+// script itself printed; everything else the sandbox has to say goes to
+// System or VMM.
+type Output struct {
+	Stdout io.Writer
+	Stderr io.Writer
+	// System gets the runner's own log and the guest boot console
+	System io.Writer
+	// VMM gets the hypervisor's log, if the backend has one
+	VMM io.Writer
+	// Artifacts gets a tar archive of the files the script left in
+	// $OUT_DIR once it exits; nil discards them
+	Artifacts io.Writer
+}
+
+// Result describes how a run ended
+type Result struct {
+	// TimedOut is set when the script did not finish before
+	// VMConfig.Timeout and had to be stopped
+	TimedOut bool
+	// ExitCode is the script's exit code, nil if the sandbox never
+	// reported one
+	ExitCode *int
+	// Usage is what the script consumed, nil if the sandbox couldn't tell
+	Usage *Usage
+	// VM is what the sandbox consumed on the host, nil if the backend
+	// doesn't account for it
+	VM *VMUsage
+	// Metrics is what the VMM reported about the VM, nil if the backend
+	// has no VMM or it reported nothing
+	Metrics  *VMMMetrics
+	Duration time.Duration
+}
+
+// Usage is the resource consumption of the script process
+type Usage struct {
+	UserCPU   time.Duration
+	SystemCPU time.Duration
+	MaxRSSKB  int64
+}
+
+// VMUsage is the resource consumption of a VM on the host, counted from
+// its VMM's cgroup and the host end of its network device
+type VMUsage struct {
+	CPUTime         time.Duration
+	PeakMemoryBytes int64
+	BlockReadBytes  int64
+	BlockWriteBytes int64
+	// NetRxBytes and NetTxBytes are received and sent by the guest
+	NetRxBytes int64
+	NetTxBytes int64
+}
+
+// defaultTimeout is used when VMConfig.Timeout is not set
+const defaultTimeout = 5 * time.Minute
+
+// scriptEnv adds OUT_DIR to the script's environment
+func scriptEnv(env map[string]string, outDir string) map[string]string {
+	merged := make(map[string]string, len(env)+1)
+	for k, v := range env {
+		merged[k] = v
+	}
+	merged["OUT_DIR"] = outDir
+	return merged
+}
+
+// scriptCommand appends the script to the runtime's interpreter command
+func scriptCommand(interpreter []string, script string) []string {
+	cmd := make([]string, 0, len(interpreter)+1)
+	cmd = append(cmd, interpreter...)
+	return append(cmd, script)
+}
+
+// New returns the runner backend registered under name
+func New(name string) (Runner, error) {
+	switch name {
+	case "firecracker", "":
+		return Firecracker{}, nil
+	case "local":
+		return Local{}, nil
+	default:
+		return nil, fmt.Errorf("unknown runner backend %q", name)
+	}
+}
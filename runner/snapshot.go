@@ -0,0 +1,382 @@
+package runner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	firecracker "github.com/firecracker-microvm/firecracker-go-sdk"
+	"github.com/sirupsen/logrus"
+
+	"github.com/steveoni/microvm/agent"
+)
+
+const (
+	// snapshotBuildTimeout bounds booting, warming up and snapshotting a
+	// golden VM
+	snapshotBuildTimeout = 3 * time.Minute
+	// snapshotRetryDelay spaces out attempts at a snapshot that failed to
+	// build, so a broken image doesn't spin
+	snapshotRetryDelay = time.Minute
+	// identityTimeout bounds how long a restored guest may take to answer
+	// with its new identity
+	identityTimeout = 10 * time.Second
+)
+
+// The files of a snapshot: the VM state, the guest memory and the golden
+// VM's disk as it was when the snapshot was taken
+const (
+	snapshotStateFile  = "vmstate"
+	snapshotMemoryFile = "memory"
+	snapshotRootFSFile = "rootfs.ext4"
+	// snapshotTmpMark names a snapshot directory still being written
+	snapshotTmpMark = ".tmp-"
+)
+
+// snapshotStats is published at /debug/vars: snapshots built and failed
+// to build, VMs restored and failed to restore, and VMs booted because
+// their snapshot wasn't ready.
+var snapshotStats = expvar.NewMap("snapshots")
+
+// snapshotStore keeps a snapshot per VM shape and image, each in a
+// directory named by snapshotStore.key. A missing snapshot is built in the
+// background the first time a VM needs it.
+type snapshotStore struct {
+	dir string
+	// version is firecracker's, whose snapshots only it can restore
+	version string
+
+	mu       sync.Mutex
+	building map[string]bool
+	retryAt  map[string]time.Time
+	digests  map[string]fileDigest
+}
+
+// fileDigest is the sha256 of a file, valid while its size and
+// modification time are unchanged
+type fileDigest struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+type snapshot struct {
+	name string
+	dir  string
+}
+
+// snapshots is nil unless EnableSnapshots was called
+var snapshots *snapshotStore
+
+// EnableSnapshots makes the firecracker runner restore VMs from snapshots
+// of golden VMs kept in dir, built once per kernel and rootfs image,
+// runtime warmup and VM shape. Jobs with kernel arguments of their own
+// are still booted.
+func EnableSnapshots(dir string) error {
+	out, err := exec.Command("firecracker", "--version").Output()
+	if err != nil {
+		return fmt.Errorf("failed to get firecracker version: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// Builds cut short by a restart are never finished
+	tmps, err := filepath.Glob(filepath.Join(dir, "*"+snapshotTmpMark+"*"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		os.RemoveAll(tmp)
+	}
+
+	snapshots = &snapshotStore{
+		dir:      dir,
+		version:  strings.TrimSpace(string(out)),
+		building: make(map[string]bool),
+		retryAt:  make(map[string]time.Time),
+		digests:  make(map[string]fileDigest),
+	}
+	return nil
+}
+
+// lookup returns the snapshot to restore a VM shaped by cfg from, or nil
+// if it isn't ready, in which case it starts building it
+func (s *snapshotStore) lookup(cfg VMConfig) *snapshot {
+	// Kernel arguments can't be changed on a restored guest
+	if s == nil || cfg.KernelArgs != "" {
+		return nil
+	}
+
+	shape, name, err := s.key(cfg)
+	if err != nil {
+		logrus.Warnf("Failed to look up snapshot: %v", err)
+		return nil
+	}
+	dir := filepath.Join(s.dir, name)
+	if _, err := os.Stat(filepath.Join(dir, snapshotStateFile)); err == nil {
+		return &snapshot{name: name, dir: dir}
+	}
+	snapshotStats.Add("misses", 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.building[name] || time.Now().Before(s.retryAt[name]) {
+		return nil
+	}
+	s.building[name] = true
+	go s.build(cfg, shape, name)
+	return nil
+}
+
+// key returns the hash of cfg's VM shape and the name of its snapshot,
+// which is the shape followed by a hash of the firecracker version and the
+// content of the kernel and rootfs, so a new image gets a new snapshot.
+// Jailed VMs, which can only read snapshots made by jailed VMs, have
+// snapshots of their own.
+func (s *snapshotStore) key(cfg VMConfig) (shape, name string, err error) {
+	kernelPath, err := filepath.Abs(cfg.KernelImagePath)
+	if err != nil {
+		return "", "", err
+	}
+	rootfsPath, err := filepath.Abs(cfg.RootFSPath)
+	if err != nil {
+		return "", "", err
+	}
+
+	h := sha256.New()
+	json.NewEncoder(h).Encode([]interface{}{kernelPath, rootfsPath, cfg.MemSizeMB, cfg.CPUs, cfg.EnableNetwork, cfg.Warmup, jailer != nil})
+	shape = hex.EncodeToString(h.Sum(nil))[:16]
+
+	kernel, err := s.digest(kernelPath)
+	if err != nil {
+		return "", "", err
+	}
+	rootfs, err := s.digest(rootfsPath)
+	if err != nil {
+		return "", "", err
+	}
+	image := sha256.Sum256([]byte(s.version + "\n" + kernel + "\n" + rootfs))
+	return shape, shape + "-" + hex.EncodeToString(image[:])[:16], nil
+}
+
+// digest returns the sha256 of the file at path, hashing it again only
+// when it has changed since the last call
+func (s *snapshotStore) digest(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	d, ok := s.digests[path]
+	s.mu.Unlock()
+	if ok && d.size == info.Size() && d.modTime.Equal(info.ModTime()) {
+		return d.sum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	d = fileDigest{size: info.Size(), modTime: info.ModTime(), sum: hex.EncodeToString(h.Sum(nil))}
+	s.mu.Lock()
+	s.digests[path] = d
+	s.mu.Unlock()
+	return d.sum, nil
+}
+
+// build makes snapshot name of a VM shaped by cfg, then removes the
+// snapshots of older images of the same shape
+func (s *snapshotStore) build(cfg VMConfig, shape, name string) {
+	logger := logrus.WithField("snapshot", name)
+	logger.Info("Building snapshot...")
+	err := s.create(cfg, name)
+
+	s.mu.Lock()
+	delete(s.building, name)
+	if err != nil {
+		s.retryAt[name] = time.Now().Add(snapshotRetryDelay)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		snapshotStats.Add("build_failures", 1)
+		logger.Warnf("Failed to build snapshot: %v", err)
+		return
+	}
+	snapshotStats.Add("builds", 1)
+	logger.Info("Snapshot ready")
+
+	old, err := filepath.Glob(filepath.Join(s.dir, shape+"-*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range old {
+		if base := filepath.Base(dir); base != name && !strings.Contains(base, snapshotTmpMark) {
+			logger.Infof("Removing outdated snapshot %s", base)
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// create boots a golden VM, has it run cfg's warmup and snapshots it. The
+// snapshot is written next to its final place and only moved there once
+// complete.
+func (s *snapshotStore) create(cfg VMConfig, name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotBuildTimeout)
+	defer cancel()
+
+	shape := VMConfig{
+		KernelImagePath: cfg.KernelImagePath,
+		RootFSPath:      cfg.RootFSPath,
+		MemSizeMB:       cfg.MemSizeMB,
+		CPUs:            cfg.CPUs,
+		EnableNetwork:   cfg.EnableNetwork,
+		Warmup:          cfg.Warmup,
+	}
+	vm, err := bootVM(ctx, shape, "", newRelay(nil), newRelay(nil), true)
+	if err != nil {
+		return err
+	}
+	defer vm.destroy()
+
+	if err := pingAgent(ctx, vm.vsockPath, vm.logger); err != nil {
+		return err
+	}
+	if len(shape.Warmup) > 0 {
+		if err := warmAgent(ctx, vm.vsockPath, shape.Warmup, vm.logger); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.MkdirTemp(s.dir, name+snapshotTmpMark)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// The VMM writes the snapshot into the VM's directory, which is all a
+	// jailed VMM sees
+	if err := vm.machine.PauseVM(ctx); err != nil {
+		return fmt.Errorf("failed to pause VM: %w", err)
+	}
+	err = vm.machine.CreateSnapshot(ctx, vm.vmmPath(snapshotMemoryFile), vm.vmmPath(snapshotStateFile))
+	if err != nil {
+		return fmt.Errorf("failed to snapshot VM: %w", err)
+	}
+
+	// The disk is kept as the snapshot left it, so the VMM goes first
+	if err := vm.machine.StopVMM(); err != nil {
+		return fmt.Errorf("failed to stop VM: %w", err)
+	}
+	vm.halt()
+	for _, file := range []string{snapshotMemoryFile, snapshotStateFile, snapshotRootFSFile} {
+		src, dst := filepath.Join(vm.dir, file), filepath.Join(tmp, file)
+		if err := os.Rename(src, dst); err != nil {
+			// The VM's directory may be on another filesystem
+			if err := cloneRootFS(src, dst); err != nil {
+				return err
+			}
+		}
+		// Jailed VMs restored from the snapshot open it as the jail's user
+		if jailer != nil {
+			if err := os.Chown(dst, jailer.UID, jailer.GID); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, name))
+}
+
+// restoreVM starts a VM shaped by cfg from snap and gives its guest an
+// identity of its own: the address leased for it, a reseeded RNG and the
+// host's time. The VMM is killed when ctx is done.
+func restoreVM(ctx context.Context, cfg VMConfig, snap *snapshot, system, vmmLog *relay) (_ *microVM, err error) {
+	vm, err := newMicroVM(system, vmmLog)
+	if err != nil {
+		return nil, err
+	}
+	logrusEntry := vm.logger
+	defer func() {
+		if err != nil {
+			vm.destroy()
+		}
+	}()
+
+	if _, err := vm.setupNetwork(cfg, true); err != nil {
+		return nil, err
+	}
+
+	// The snapshot's devices are found relative to the VM's directory
+	disk := filepath.Join(vm.dir, "rootfs.ext4")
+	if err := cloneRootFS(filepath.Join(snap.dir, snapshotRootFSFile), disk); err != nil {
+		return nil, err
+	}
+	if err := vm.own(disk); err != nil {
+		return nil, err
+	}
+	memory, err := vm.expose(filepath.Join(snap.dir, snapshotMemoryFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add snapshot to jail: %w", err)
+	}
+	state, err := vm.expose(filepath.Join(snap.dir, snapshotStateFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add snapshot to jail: %w", err)
+	}
+
+	io.WriteString(system, "\n\n===== VM SERIAL CONSOLE =====\n\n")
+	// The machine's shape and devices all come from the snapshot
+	fcCfg := vm.machineConfig(firecracker.Config{DisableValidation: true})
+	vmmCmd := vm.vmmCommand(ctx, cfg, fcCfg.SocketPath)
+
+	resume := func(c *firecracker.SnapshotConfig) { c.ResumeVM = true }
+	machine, err := firecracker.NewMachine(ctx, fcCfg,
+		vm.machineOpts(vmmCmd, firecracker.WithSnapshot(memory, state, resume))...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create VM: %w", err)
+	}
+	vm.machine = machine
+
+	logrusEntry.Infof("Restoring VM from snapshot %s...", snap.name)
+	if err := machine.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to restore VM: %w", err)
+	}
+	go vm.readLog(filepath.Join(vm.dir, "console.fifo"))
+	vm.readMetrics(filepath.Join(vm.dir, "metrics.fifo"))
+
+	id := agent.Identity{Seed: make([]byte, 64), Time: time.Now()}
+	if _, err := rand.Read(id.Seed); err != nil {
+		return nil, err
+	}
+	if lease := vm.lease; lease != nil {
+		ones, _ := ipam.Subnet().Mask.Size()
+		id.MAC = lease.MAC
+		id.Address = fmt.Sprintf("%s/%d", lease.IP, ones)
+		id.Gateway = ipam.Gateway().String()
+	}
+	idCtx, cancel := context.WithTimeout(ctx, identityTimeout)
+	defer cancel()
+	if err := sendIdentity(idCtx, vm.vsockPath, id, logrusEntry); err != nil {
+		return nil, fmt.Errorf("restored guest did not take its identity: %w", err)
+	}
+
+	snapshotStats.Add("restores", 1)
+	logrusEntry.Infof("Restored VM from snapshot %s with address %s", snap.name, id.Address)
+	return vm, nil
+}
@@ -0,0 +1,168 @@
+// Package runtimes is the registry of languages scripts can be written in.
+// A runtime says how to recognise a script, from its shebang or file
+// extension, and how to run it, with an interpreter command and optionally
+// its own rootfs image carrying that interpreter.
+package runtimes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Runtime describes one supported language
+type Runtime struct {
+	Name string `json:"name"`
+	// Extensions are matched against the entrypoint, including the dot
+	Extensions []string `json:"extensions"`
+	// Shebangs are interpreter names matched against the entrypoint's #!
+	// line, with or without /usr/bin/env
+	Shebangs []string `json:"shebangs"`
+	// Command runs the entrypoint, which is appended to it
+	Command []string `json:"command"`
+	// RootFS is the guest image to boot, empty for the default one
+	RootFS string `json:"rootfs,omitempty"`
+	// Warmup is run in the guest before it is snapshotted, so that guests
+	// restored from the snapshot start with the runtime already in memory
+	Warmup []string `json:"warmup,omitempty"`
+}
+
+// ErrUnsupported is returned for a script no runtime recognises
+var ErrUnsupported = errors.New("unsupported script type")
+
+var (
+	mu       sync.RWMutex
+	registry = map[string]Runtime{}
+)
+
+func init() {
+	Register(Runtime{
+		Name:       "sh",
+		Extensions: []string{".sh"},
+		Shebangs:   []string{"sh", "ash", "bash"},
+		Command:    []string{"sh"},
+	})
+	Register(Runtime{
+		Name:       "python",
+		Extensions: []string{".py"},
+		Shebangs:   []string{"python", "python3"},
+		Command:    []string{"python3"},
+		Warmup:     []string{"python3", "-c", "import json, os, re, subprocess, urllib.request"},
+	})
+}
+
+// Register adds rt, replacing any runtime with the same name
+func Register(rt Runtime) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry[rt.Name] = rt
+}
+
+// LoadFile registers every runtime in a JSON array at path, so new
+// languages and images can be added without a rebuild
+func LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rts []Runtime
+	if err := json.Unmarshal(data, &rts); err != nil {
+		return fmt.Errorf("invalid runtimes file %s: %w", path, err)
+	}
+	for _, rt := range rts {
+		if rt.Name == "" || len(rt.Command) == 0 {
+			return fmt.Errorf("invalid runtimes file %s: every runtime needs a name and a command", path)
+		}
+		Register(rt)
+	}
+	return nil
+}
+
+// Get returns the runtime registered under name
+func Get(name string) (Runtime, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	rt, ok := registry[name]
+	if !ok {
+		return Runtime{}, fmt.Errorf("%w: no runtime named %q", ErrUnsupported, name)
+	}
+	return rt, nil
+}
+
+// All returns every registered runtime, sorted by name
+func All() []Runtime {
+	mu.RLock()
+	defer mu.RUnlock()
+	rts := make([]Runtime, 0, len(registry))
+	for _, rt := range registry {
+		rts = append(rts, rt)
+	}
+	sort.Slice(rts, func(i, j int) bool { return rts[i].Name < rts[j].Name })
+	return rts
+}
+
+// Detect picks the runtime for an entrypoint called name whose content
+// starts with head. A shebang wins over the extension.
+func Detect(name string, head io.Reader) (Runtime, error) {
+	interp := shebang(head)
+	ext := path.Ext(name)
+
+	// Sorted so two runtimes claiming the same extension resolve the same
+	// way every time
+	rts := All()
+	if interp != "" {
+		for _, rt := range rts {
+			for _, s := range rt.Shebangs {
+				if s == interp {
+					return rt, nil
+				}
+			}
+		}
+	}
+	if ext != "" {
+		for _, rt := range rts {
+			for _, e := range rt.Extensions {
+				if strings.EqualFold(e, ext) {
+					return rt, nil
+				}
+			}
+		}
+	}
+	return Runtime{}, fmt.Errorf("%w: %s", ErrUnsupported, name)
+}
+
+// shebang returns the interpreter named on a #! first line, looking past
+// /usr/bin/env and its flags
+func shebang(r io.Reader) string {
+	line, err := bufio.NewReaderSize(r, 256).ReadSlice('\n')
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return ""
+	}
+	if !bytes.HasPrefix(line, []byte("#!")) {
+		return ""
+	}
+
+	fields := strings.Fields(string(line[2:]))
+	if len(fields) == 0 {
+		return ""
+	}
+	interp := path.Base(fields[0])
+	if interp == "env" {
+		interp = ""
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "-") && !strings.Contains(f, "=") {
+				interp = path.Base(f)
+				break
+			}
+		}
+	}
+	return interp
+}
@@ -0,0 +1,45 @@
+package runtimes
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string // empty when unsupported
+	}{
+		{"extension", "main.py", "print(1)\n", "python"},
+		{"extension case", "RUN.SH", "echo hi\n", "sh"},
+		{"shebang", "main", "#!/bin/sh\necho hi\n", "sh"},
+		{"shebang wins", "main.py", "#!/bin/bash\necho hi\n", "sh"},
+		{"env", "tool", "#!/usr/bin/env python3\nprint(1)\n", "python"},
+		{"env flags", "tool", "#!/usr/bin/env -S PYTHONUNBUFFERED=1 python3 -u\n", "python"},
+		{"shebang without newline", "tool", "#!/usr/bin/python3", "python"},
+		{"unknown shebang falls back", "main.sh", "#!/usr/bin/perl\n", "sh"},
+		{"unknown", "main.rb", "puts 1\n", ""},
+		{"no extension", "main", "echo hi\n", ""},
+		{"empty", "main", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt, err := Detect(tt.file, strings.NewReader(tt.content))
+			if tt.want == "" {
+				if !errors.Is(err, ErrUnsupported) {
+					t.Fatalf("got %q, %v, want ErrUnsupported", rt.Name, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if rt.Name != tt.want {
+				t.Errorf("got %q, want %q", rt.Name, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// AddArchive unpacks a .tar, .tar.gz, .tgz or .zip bundle into the tree,
+// picking the format from name. Only regular files are kept; links and
+// special files are skipped.
+func (u *Upload) AddArchive(name string, r io.Reader) error {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+		}
+		defer gz.Close()
+		return u.addTar(gz)
+	case strings.HasSuffix(lower, ".tar"):
+		return u.addTar(r)
+	case strings.HasSuffix(lower, ".zip"):
+		return u.addZip(r)
+	}
+	return fmt.Errorf("%w: %q is not a .tar, .tar.gz, .tgz or .zip archive", ErrInvalidUpload, name)
+}
+
+func (u *Upload) addTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := u.AddFile(hdr.Name, tr, os.FileMode(hdr.Mode)); err != nil {
+			return err
+		}
+	}
+}
+
+// addZip spools the archive to disk since zip keeps its index at the end
+func (u *Upload) addZip(r io.Reader) error {
+	tmp, err := os.CreateTemp(u.dir, ".bundle-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, io.LimitReader(r, MaxSize+1))
+	if err != nil {
+		return err
+	}
+	if n > MaxSize {
+		return fmt.Errorf("%w: larger than %d bytes", ErrInvalidUpload, MaxSize)
+	}
+
+	zr, err := zip.NewReader(tmp, n)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+	}
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+		}
+		err = u.AddFile(f.Name, rc, f.Mode())
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,449 @@
+// Package storage keeps uploaded scripts on the local disk. Each script is
+// a directory under scripts/ holding one file tree per revision, so a job
+// can ship helpers and data files alongside the file it runs. What each
+// tree is, its entrypoint, runtime and so on, is recorded in the scripts
+// and script_revisions tables.
+package storage
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/steveoni/microvm/db"
+	"github.com/steveoni/microvm/runtimes"
+)
+
+// Root is the directory scripts are stored under
+const Root = "scripts"
+
+// Limits on a single script's tree
+const (
+	MaxFiles = 1000
+	MaxSize  = 64 << 20
+)
+
+// filesName is the tree of an upload in staging
+const filesName = "files"
+
+const revisionsName = "revisions"
+
+// ErrInvalidUpload wraps every problem with the content of an upload, as
+// opposed to a failure to store it
+var ErrInvalidUpload = errors.New("invalid upload")
+
+// Dir returns the directory holding the file tree of a script's revision
+func Dir(id string, revision int) string {
+	return filepath.Join(Root, id, revisionsName, strconv.Itoa(revision))
+}
+
+// Remove deletes a script's files
+func Remove(id string) error {
+	return os.RemoveAll(filepath.Join(Root, id))
+}
+
+// ErrFileNotFound is returned for a path that isn't one of a script's files
+var ErrFileNotFound = errors.New("file not found")
+
+// Files lists the slash separated paths of a script revision's files
+func Files(id string, revision int) ([]string, error) {
+	dir := Dir(id, revision)
+	files := []string{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	return files, err
+}
+
+// File returns the path on disk of name, one of a script revision's files
+func File(id string, revision int, name string) (string, error) {
+	// Cleaning from the root keeps ".." from leaving the script's tree
+	file := filepath.Join(Dir(id, revision), filepath.FromSlash(path.Clean("/"+name)))
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", ErrFileNotFound
+	}
+	return file, nil
+}
+
+// Upload collects the files of a new script in a staging directory until
+// it is committed
+type Upload struct {
+	dir   string
+	files []string
+	size  int64
+}
+
+// NewUpload starts a new script or revision. Either Commit, Revise or
+// Discard it.
+func NewUpload() (*Upload, error) {
+	if err := os.MkdirAll(Root, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(Root, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(filepath.Join(dir, filesName), 0755); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return &Upload{dir: dir}, nil
+}
+
+// AddFile stores r at name, a slash separated path within the tree
+func (u *Upload) AddFile(name string, r io.Reader, mode os.FileMode) error {
+	name = path.Clean(strings.TrimPrefix(name, "./"))
+	if name == "." || path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+		return fmt.Errorf("%w: bad file name %q", ErrInvalidUpload, name)
+	}
+	if len(u.files) >= MaxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrInvalidUpload, MaxFiles)
+	}
+
+	target := filepath.Join(u.dir, filesName, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("%w: %q clashes with another file", ErrInvalidUpload, name)
+	}
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode.Perm()|0644)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %q appears twice", ErrInvalidUpload, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(out, io.LimitReader(r, MaxSize-u.size+1))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	u.size += n
+	if u.size > MaxSize {
+		return fmt.Errorf("%w: larger than %d bytes", ErrInvalidUpload, MaxSize)
+	}
+	u.files = append(u.files, name)
+	return nil
+}
+
+// Commit stores the script under a new ID as its first revision and
+// records it. s carries the
+// Filename, defaulting to the entrypoint's, and Owner; its Entrypoint may
+// be empty when the script is a single file, and its Runtime when it can
+// be told from the entrypoint's shebang or extension. The rest is filled
+// in.
+func (u *Upload) Commit(s db.Script) (*db.Script, error) {
+	if err := u.describe(&s); err != nil {
+		return nil, err
+	}
+	s.ID = uuid.NewString()
+	s.Revision = 1
+	s.UploadedAt = time.Now().UTC().Format(time.RFC3339)
+
+	// The tree is moved to its revision's place within the staging
+	// directory so the script appears whole
+	if err := os.Mkdir(filepath.Join(u.dir, revisionsName), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(u.dir, filesName), filepath.Join(u.dir, revisionsName, "1")); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(u.dir, filepath.Join(Root, s.ID)); err != nil {
+		return nil, err
+	}
+	if err := db.InsertScript(s); err != nil {
+		Remove(s.ID)
+		return nil, fmt.Errorf("failed to record script: %w", err)
+	}
+	return &s, nil
+}
+
+// reviseMu keeps two new revisions of one script from taking the same
+// number
+var reviseMu sync.Mutex
+
+// Revise stores the upload as the next revision of an existing script and
+// records it. s is filled in as for Commit; its ID names the script.
+// Earlier revisions are left as they are.
+func (u *Upload) Revise(s db.Script) (*db.Script, error) {
+	if err := u.describe(&s); err != nil {
+		return nil, err
+	}
+
+	reviseMu.Lock()
+	defer reviseMu.Unlock()
+
+	latest, err := db.GetScriptByID(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.Revision = latest.Revision + 1
+	s.Owner, s.UploadedAt, s.DeletedAt = latest.Owner, latest.UploadedAt, latest.DeletedAt
+
+	// A tree under the new number can only be left from a revision that
+	// was never recorded
+	target := Dir(s.ID, s.Revision)
+	if err := os.RemoveAll(target); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(u.dir, filesName), target); err != nil {
+		return nil, err
+	}
+	if err := db.AddScriptRevision(s, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		os.RemoveAll(target)
+		return nil, fmt.Errorf("failed to record revision: %w", err)
+	}
+	return &s, nil
+}
+
+// describe checks the upload's entrypoint and runtime and fills in what s
+// says about its files
+func (u *Upload) describe(s *db.Script) error {
+	if s.Entrypoint == "" {
+		if len(u.files) != 1 {
+			return fmt.Errorf("%w: an entrypoint is required with %d files", ErrInvalidUpload, len(u.files))
+		}
+		s.Entrypoint = u.files[0]
+	}
+	s.Entrypoint = path.Clean(strings.TrimPrefix(s.Entrypoint, "./"))
+	found := false
+	for _, f := range u.files {
+		if f == s.Entrypoint {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: entrypoint %q is not one of the uploaded files", ErrInvalidUpload, s.Entrypoint)
+	}
+
+	rt, err := u.runtime(s.Entrypoint, s.Runtime)
+	if err != nil {
+		return err
+	}
+	s.Runtime = rt.Name
+	if s.Filename == "" {
+		s.Filename = path.Base(s.Entrypoint)
+	}
+
+	s.Size, s.Checksum, err = summarize(filepath.Join(u.dir, filesName))
+	return err
+}
+
+// runtime resolves the runtime asked for, or detects it from the entrypoint
+func (u *Upload) runtime(entrypoint, name string) (runtimes.Runtime, error) {
+	var (
+		rt  runtimes.Runtime
+		err error
+	)
+	if name != "" {
+		rt, err = runtimes.Get(name)
+	} else {
+		var f *os.File
+		f, err = os.Open(filepath.Join(u.dir, filesName, filepath.FromSlash(entrypoint)))
+		if err != nil {
+			return rt, err
+		}
+		defer f.Close()
+		rt, err = runtimes.Detect(entrypoint, f)
+	}
+	if errors.Is(err, runtimes.ErrUnsupported) {
+		return rt, fmt.Errorf("%w: %v", ErrInvalidUpload, err)
+	}
+	return rt, err
+}
+
+// Discard removes an upload that was not committed, or what is left of it
+// after Revise
+func (u *Upload) Discard() {
+	os.RemoveAll(u.dir)
+}
+
+// summarize returns the total size of the regular files under dir and the
+// sha256 of their sha256sum listing, in path order
+func summarize(dir string) (int64, string, error) {
+	var size int64
+	listing := sha256.New()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		n, err := io.Copy(h, f)
+		if err != nil {
+			return err
+		}
+		size += n
+		fmt.Fprintf(listing, "%x  %s\n", h.Sum(nil), filepath.ToSlash(rel))
+		return nil
+	})
+	return size, hex.EncodeToString(listing.Sum(nil)), err
+}
+
+// Init brings scripts stored by earlier versions, each a single
+// scripts/<id><ext> file, into the scripts table as revision 1 of a tree of
+// their own. It also clears up after uploads and migrations interrupted by
+// a crash.
+func Init() error {
+	entries, err := os.ReadDir(Root)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() && strings.HasPrefix(name, ".") {
+			if err := recoverStaging(filepath.Join(Root, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if e.Type().IsRegular() {
+			id := strings.TrimSuffix(name, filepath.Ext(name))
+			if _, err := uuid.Parse(id); err != nil {
+				continue
+			}
+			if err := migrate(id, name); err != nil {
+				return fmt.Errorf("failed to migrate script %s: %w", name, err)
+			}
+		}
+	}
+
+	// Every tree needs a record, including the ones just migrated
+	entries, err = os.ReadDir(Root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := uuid.Parse(e.Name()); err != nil || !e.IsDir() {
+			continue
+		}
+		if _, err := db.GetScriptByID(e.Name()); err != sql.ErrNoRows {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := adopt(e.Name()); err != nil {
+			return fmt.Errorf("failed to record script %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
+
+// migrate moves a single-file script into its own tree
+func migrate(id, name string) error {
+	staging, err := os.MkdirTemp(Root, ".migrate-")
+	if err != nil {
+		return err
+	}
+	tree := filepath.Join(staging, revisionsName, "1")
+	if err := os.MkdirAll(tree, 0755); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	// The file moves out first; a script without an extension has the
+	// same name as its new directory
+	if err := os.Rename(filepath.Join(Root, name), filepath.Join(tree, name)); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	return os.Rename(staging, filepath.Join(Root, id))
+}
+
+// recoverStaging deals with a staging directory left by a crash. Uploads
+// are dropped and a migration whose script already moved in is finished.
+func recoverStaging(dir string) error {
+	base := filepath.Base(dir)
+	if !strings.HasPrefix(base, ".migrate-") {
+		return os.RemoveAll(dir)
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, revisionsName, "1"))
+	if err != nil || len(entries) != 1 {
+		return os.RemoveAll(dir)
+	}
+	name := entries[0].Name()
+	return os.Rename(dir, filepath.Join(Root, strings.TrimSuffix(name, filepath.Ext(name))))
+}
+
+// adopt records a migrated script, whose only file is its entrypoint
+func adopt(id string) error {
+	entries, err := os.ReadDir(Dir(id, 1))
+	if err != nil {
+		return err
+	}
+	if len(entries) != 1 || !entries[0].Type().IsRegular() {
+		log.Printf("Skipping script %s: can't tell its entrypoint", id)
+		return nil
+	}
+
+	s := db.Script{ID: id, Entrypoint: entries[0].Name()}
+	entry := filepath.Join(Dir(id, 1), s.Entrypoint)
+	info, err := os.Stat(entry)
+	if err != nil {
+		return err
+	}
+	s.Runtime = detectRuntime(entry)
+	s.Filename = s.Entrypoint
+	s.UploadedAt = info.ModTime().UTC().Format(time.RFC3339)
+	s.Size, s.Checksum, err = summarize(Dir(id, 1))
+	if err != nil {
+		return err
+	}
+	return db.InsertScript(s)
+}
+
+// detectRuntime picks the runtime of a script stored before uploads were
+// checked. Those always ran with sh unless they were Python.
+func detectRuntime(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return "sh"
+	}
+	defer f.Close()
+	rt, err := runtimes.Detect(filepath.Base(file), f)
+	if err != nil {
+		return "sh"
+	}
+	return rt.Name
+}
@@ -2,6 +2,7 @@
 set -e
 
 WORK_DIR=$(mktemp -d)
+REPO_DIR=$(cd "$(dirname "$0")/.." && pwd)
 OUTPUT_DIR="/home/steveoni/Documents/personal/microvm/vm/images"
 
 echo "Creating working directory: $WORK_DIR"
@@ -105,6 +106,11 @@ chmod +x rootfs/bin/python-wrapper
 ln -sf /bin/python-wrapper rootfs/bin/python
 ln -sf /bin/python-wrapper rootfs/bin/python3
 
+# Build the guest agent as a static binary
+echo "Building guest agent..."
+(cd $REPO_DIR && CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o $WORK_DIR/rootfs/bin/guest-agent ./cmd/guest-agent)
+chmod +x $WORK_DIR/rootfs/bin/guest-agent
+
 # Create ld.so.conf to ensure libraries are found
 echo "/usr/local/lib" > rootfs/etc/ld.so.conf
 
@@ -153,18 +159,7 @@ echo "Testing DNS resolution with busybox:"
 busybox nslookup google.com || echo "Busybox DNS resolution failed"
 
 
-# Mount script drive
-mkdir -p /mnt/script
-mount /dev/vdb /mnt/script
-if [ \$? -ne 0 ]; then
-    echo "ERROR: Failed to mount script drive!"
-    sleep 5
-    poweroff -f
-fi
-
 # Debug output
-echo "Script drive mounted, contents:"
-ls -la /mnt/script
 echo "System information:"
 uname -a
 echo "Available binaries:"
@@ -181,43 +176,17 @@ fi
 echo "Library path:"
 echo \$LD_LIBRARY_PATH
 
-# Execute the script based on file extension
-echo "===== SCRIPT EXECUTION START ====="
-echo "Python version: \$(python3 --version 2>&1 || echo 'Not available')"
-echo "PATH: \$PATH"
-
-for script in /mnt/script/*; do
-    if [ -f "\$script" ]; then
-        case "\${script##*.}" in
-            py)
-                echo "Running Python script: \$script"
-                if command -v python3 > /dev/null; then
-                    python3 "\$script" 2>&1
-                    EXIT_CODE=\$?
-                else
-                    echo "ERROR: Python is not properly installed in this VM"
-                    EXIT_CODE=127
-                fi
-                ;;
-            sh|bash)
-                echo "Running shell script: \$script"
-                sh "\$script" 2>&1
-                EXIT_CODE=\$?
-                ;;
-            *)
-                echo "Running as shell script: \$script"
-                sh "\$script" 2>&1
-                EXIT_CODE=\$?
-                ;;
-        esac
-    fi
-done
-echo "===== SCRIPT EXECUTION END (EXIT CODE: \$EXIT_CODE) ====="
+# Hand over to the guest agent: it waits for the host on vsock, unpacks
+# the script drive, runs the job and reboots the VM once the host has the
+# result. Firecracker has no ACPI, so a reboot (not poweroff) is what makes
+# the VMM exit.
+echo "Starting guest agent..."
+/bin/guest-agent
 
-# Power off the VM when done
+# Only reached if the agent failed
 sync
-echo "Powering off VM..."
-poweroff -f
+echo "Guest agent exited, rebooting VM..."
+reboot -f
 EOF
 
 # Make sure init is executable